@@ -22,30 +22,151 @@
 //	c.GetBool("service-1","allow-writing")       // returns false
 //	c.GetInt("service-1", "port")                // returns 0 and a GetError
 //
-// Note that all section and option names are case insensitive. All values are case
-// sensitive.
+// Note that all section and option names are case insensitive, unless the
+// CaseSensitive field is set. All values are case sensitive.
 //
 // Goconfig's string substitution syntax has not been removed. However, it may be
 // taken out or modified in the future.
 package conf
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // ConfigFile is the representation of configuration settings.
-// The public interface is entirely through methods.
+// The public interface is entirely through methods, which are safe for concurrent use.
+// Slices and maps returned by the methods are snapshots that remain valid, and can be
+// modified, regardless of later changes to the configuration. GetString holds the lock
+// for the whole unfolding, so it never observes a partially applied change.
+// The configurable fields such as ListSeparator must be set before the configuration
+// is shared between goroutines.
 type ConfigFile struct {
-	data map[string]ConfigSection // Maps sections to options to values.
+	mu sync.RWMutex // Guards the fields below.
+
+	data     map[string]ConfigSection // Maps sections to options to values.
+	sections []string                 // Section names in insertion order.
+	options  map[string][]string      // Maps sections to option names in insertion order.
+
+	// Comment and blank lines read from a file, kept to write them back.
+	sectionComments map[string][]string            // Maps sections to the lines preceding their header.
+	optionComments  map[string]map[string][]string // Maps sections to options to the lines preceding them.
+	header          []string                       // Comment lines opening the file, followed by a blank line.
+	footer          []string                       // Lines following the last option.
+
+	arrays map[string][]string // Maps section arrays, read from [[name]] headers, to their sections.
+
+	callbacks map[string]map[string][]func(old, new string) // Registered by OnChange.
+
+	dirty   map[OptionRef]bool   // Options set or removed since the configuration was read (see Dirty).
+	sources map[OptionRef]string // Where the value of every option came from (see GetStringSource).
+
+	frozen bool // Set by Freeze: the contents can no longer change.
+
+	cacheMu sync.Mutex           // Guards cache, filled by readers holding mu.RLock.
+	cache   map[OptionRef]string // Values returned by GetString, if EnableCache is set.
+
+	ListSeparator string // Separator between list elements (see GetStringList).
+	ExpandEnv     bool   // Expand ${NAME} environment variable references in GetString.
+	CaseSensitive bool   // Do not fold the case of section and option names.
+
+	// Characters separating an option from its value. The first one found on a line,
+	// from the left, splits the line, so the value may contain any of them.
+	Delimiters []byte
+
+	// Markers starting a comment line, such as "#" or "//", matched without regard to
+	// case. A marker in the middle of a value does not start a comment, unless
+	// InlineComments is set.
+	CommentChars []string
+
+	// Make the reader fail on a section header or an option appearing twice in the same
+	// section, reporting every duplicate in a MultiError. By default the options are
+	// merged and the last value wins.
+	StrictDuplicates bool
+
+	// Make the reader join the values of an option repeated in the same section with
+	// ListSeparator, so that "server = a" followed by "server = b" reads as "a,b" and
+	// GetStringList returns both. Values read from another file or an earlier read still
+	// get overwritten. Off by default; it is exclusive with StrictDuplicates, which takes
+	// precedence and reports the repeated options.
+	AllowRepeatedKeys bool
+
+	// Strip comments starting with a CommentChars marker anywhere in a value, unless the
+	// marker is within double quotes or escaped with a backslash. A marker starting with a
+	// letter, such as "rem", only does after whitespace, so that "premium" is kept. When
+	// unset, only "#" and ";" preceded by whitespace start an inline comment.
+	InlineComments bool
+
+	// Separator replacing the underscores of the environment variable names imported by
+	// ImportEnviron, e.g. "." to turn DB_HOST into db.host. Underscores are kept when empty.
+	EnvironSeparator string
+
+	// Write values that would not read back as they are, such as values with leading or
+	// trailing spaces, within double quotes, and read values within double quotes without
+	// them (see WriteTo).
+	QuoteValues bool
+
+	// Write the sections, and the options of every section, sorted by name rather than
+	// in insertion order. The default section still comes first.
+	SortOnWrite bool
+
+	// Leave the default section out when writing, along with the comment lines preceding
+	// its options, to export only the named sections. Their values are written raw, so
+	// references to options of the default section no longer unfold once read back.
+	OmitDefault bool
+
+	// Keyword of the directive including another file while reading, such as "@include"
+	// (see ReadFrom). Include directives are not recognized when empty, the default.
+	IncludeDirective string
+
+	// Trim the whitespace surrounding unfolded values, so that every getter but the raw ones
+	// returns "value" for a value set to "value ". The reader already trims the values it
+	// reads, except those quoted with QuoteValues; setting TrimValues changes the values
+	// returned for options set with surrounding whitespace, including quoted ones.
+	TrimValues bool
+
+	// Keep the values returned by GetString, and so by the typed getters, to return them
+	// directly the next time. Any change to the configuration empties the cache. Changing
+	// settings such as ExpandEnv, or the environment, does not, so values expanded from
+	// environment variables are cached as well.
+	EnableCache bool
+
+	// Value removing an option instead of setting it, such as "!unset", when read or merged
+	// (see ReadFrom and Merge), so that a later file can undo an option of an earlier one.
+	// Values are stored as they are when empty, the default.
+	UnsetValue string
 }
 
 type ConfigSection map[string]string // Maps options to values.
 
+// OptionRef names an option of a section.
+type OptionRef struct {
+	Section string
+	Option  string
+}
+
+// DefaultListSeparator is the list separator used when ListSeparator is empty.
+const DefaultListSeparator = ","
+
+// DefaultDelimiters are the option delimiters used when Delimiters is empty.
+var DefaultDelimiters = []byte{'=', ':'}
+
+// DefaultCommentChars are the comment markers used when CommentChars is empty. "rem"
+// reads the comments of Windows files, in any case; as it has always done, it also turns
+// a line such as "remote = x" into a comment.
+var DefaultCommentChars = []string{"#", ";", "rem"}
+
+// Reason tells why a GetError or a ReadError occurred.
+type Reason int
+
 const (
 	// Get Errors
-	SectionNotFound = iota
+	SectionNotFound Reason = iota
 	OptionNotFound
 	MaxDepthReached
 
@@ -54,110 +175,1024 @@ const (
 
 	// Get and Read Errors
 	CouldNotParse
+
+	// Edit Errors
+	AlreadyExists
+	ProtectedSection
+
+	// Strict Read Errors
+	DuplicateSection
+	DuplicateOption
+
+	// Read Errors
+	MalformedSection
+	UnterminatedQuote
+
+	// Get Errors
+	InheritanceCycle
 )
 
+// ExtendsOption is the option naming the section that a section extends: with
+//
+//	[base]
+//	host = example.com
+//
+//	[prod]
+//	_extends = base
+//
+// prod holds the option host of base, as if it defined it: base may extend another section
+// in turn, and the section nearest to prod defining an option wins. The default section
+// keeps the role it has for any section, whether it extends another one or not: HasOption,
+// GetOptions, GetSectionMap and the unfolding of references see its options after those of
+// the sections extended, while GetString and GetRawString do not.
+// GetOptions, GetOptionsLocal and GetSectionMap do not list ExtendsOption itself. Sections
+// extending each other make the getters fail with an InheritanceCycle error.
+const ExtendsOption = "_extends"
+
 var (
 	DefaultSection = "default" // Default section name (must be lower-case).
 	DepthValues    = 200       // Maximum allowed depth when recursively substituing variable names.
 
-	// Strings accepted as bool.
+	// Strings accepted as bool. Values are lower-cased before the lookup, so custom
+	// spellings must be registered in lower case.
 	BoolStrings = map[string]bool{
-		"t":     true,
-		"true":  true,
-		"y":     true,
-		"yes":   true,
-		"on":    true,
-		"1":     true,
-		"f":     false,
-		"false": false,
-		"n":     false,
-		"no":    false,
-		"off":   false,
-		"0":     false,
-	}
-
-	varRegExp = regexp.MustCompile(`%\(([a-zA-Z0-9_.\-]+)\)s`)
+		"t":        true,
+		"true":     true,
+		"y":        true,
+		"yes":      true,
+		"on":       true,
+		"enabled":  true,
+		"1":        true,
+		"f":        false,
+		"false":    false,
+		"n":        false,
+		"no":       false,
+		"off":      false,
+		"disabled": false,
+		"0":        false,
+	}
+
+	varRegExp = regexp.MustCompile(`%\((?:\[([^\]]+)\])?([a-zA-Z0-9_.\-]+)(?::([^)]*))?\)s`)
+	envRegExp = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
 )
 
 // AddSection adds a new section to the configuration.
-// It returns true if the new section was inserted, and false if the section already existed.
-func (c *ConfigFile) AddSection(section string) bool {
-	section = strings.ToLower(section)
+// It returns true if the new section was inserted, and false if the section already existed,
+// in which case it is left as it is; there is no need to call HasSection first, which
+// would race with concurrent changes. It returns ErrFrozen if c is frozen.
+func (c *ConfigFile) AddSection(section string) (added bool, err error) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return false, ErrFrozen
+	}
+
+	return c.addSection(section), nil
+}
+
+// addSection is AddSection without locking.
+func (c *ConfigFile) addSection(section string) bool {
+	section = c.fold(section)
 
 	if _, ok := c.data[section]; ok {
 		return false
 	}
 	c.data[section] = make(map[string]string)
+	c.sections = append(c.sections, section)
 
 	return true
 }
 
+// AddSectionIfNotExists creates the section unless it already exists.
+// It returns true if the section was created, and false if it already existed or c is
+// frozen.
+func (c *ConfigFile) AddSectionIfNotExists(section string) bool {
+	added, _ := c.AddSection(section)
+	return added
+}
+
 // RemoveSection removes a section from the configuration.
 // It returns true if the section was removed, and false if section did not exist.
-func (c *ConfigFile) RemoveSection(section string) bool {
-	section = strings.ToLower(section)
+// It returns a ProtectedSection error for the default section, which always exists.
+func (c *ConfigFile) RemoveSection(section string) (removed bool, err error) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return false, ErrFrozen
+	}
+
+	section = c.fold(section)
 
 	switch _, ok := c.data[section]; {
-	case !ok:
-		return false
 	case section == DefaultSection:
-		return false // default section cannot be removed
+		return false, GetError{ProtectedSection, "", "", section, ""}
+	case !ok:
+		return false, nil
 	default:
 		for o, _ := range c.data[section] {
 			delete(c.data[section], o)
+			delete(c.sources, OptionRef{section, o})
+			c.markDirty(section, o)
 		}
 		delete(c.data, section)
+		delete(c.options, section)
+		delete(c.sectionComments, section)
+		delete(c.optionComments, section)
+		c.sections = removeName(c.sections, section)
+		for name, sections := range c.arrays {
+			c.arrays[name] = removeName(sections, section)
+		}
 	}
 
-	return true
+	return true, nil
+}
+
+// RenameSection renames a section, keeping its options and its position in the section order.
+// It returns an error if oldName does not exist, if newName already exists, or if oldName is
+// the default section, which cannot be renamed. A renamed element of a section array, such
+// as server.0, leaves the array (see GetSectionList) and is written as a section of its own.
+func (c *ConfigFile) RenameSection(oldName string, newName string) error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	oldName = c.fold(oldName)
+	newName = c.fold(newName)
+
+	switch _, ok := c.data[oldName]; {
+	case !ok:
+		return GetError{SectionNotFound, "", "", oldName, ""}
+	case oldName == DefaultSection:
+		return GetError{ProtectedSection, "", "", oldName, ""}
+	}
+	if _, ok := c.data[newName]; ok {
+		return GetError{AlreadyExists, "", "", newName, ""}
+	}
+
+	for option := range c.data[oldName] {
+		c.markDirty(oldName, option)
+		c.markDirty(newName, option)
+		c.setSource(newName, option, c.sources[OptionRef{oldName, option}])
+		delete(c.sources, OptionRef{oldName, option})
+	}
+	c.data[newName] = c.data[oldName]
+	c.options[newName] = c.options[oldName]
+	c.sectionComments[newName] = c.sectionComments[oldName]
+	c.optionComments[newName] = c.optionComments[oldName]
+	delete(c.data, oldName)
+	delete(c.options, oldName)
+	delete(c.sectionComments, oldName)
+	delete(c.optionComments, oldName)
+	for i, s := range c.sections {
+		if s == oldName {
+			c.sections[i] = newName
+		}
+	}
+	for name, sections := range c.arrays {
+		for i, s := range sections {
+			if s == oldName { // no longer an element, whose name would be lost on write
+				c.arrays[name] = append(sections[:i:i], sections[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// RenameVariable rewrites every %(oldName)s reference in the raw values to %(newName)s,
+// keeping the section and default of references such as %([db]oldName:x)s, and returns
+// the number of references rewritten. Escaped references, such as %%(oldName)s, are left
+// alone, and so are the options named oldName: use FindReferences before renaming them.
+// Names are compared without regard to case, unless CaseSensitive is set.
+// It returns ErrFrozen if c is frozen.
+func (c *ConfigFile) RenameVariable(oldName string, newName string) (n int, err error) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return 0, ErrFrozen
+	}
+
+	oldName = c.fold(oldName)
+	for _, section := range c.sections {
+		for _, option := range c.options[section] {
+			value := c.data[section][option]
+			refs := references(value)
+			for i := len(refs) - 1; i >= 0; i-- {
+				if vr := refs[i]; c.fold(value[vr[4]:vr[5]]) == oldName {
+					value = value[:vr[4]] + newName + value[vr[5]:]
+					n++
+				}
+			}
+			if value != c.data[section][option] {
+				c.data[section][option] = value
+				c.markDirty(section, option)
+			}
+		}
+	}
+
+	return n, nil
 }
 
 // AddOption adds a new option and value to the configuration.
 // It returns true if the option and value were inserted, and false if the value was overwritten.
 // If the section does not exist in advance, it is created.
-func (c *ConfigFile) AddOption(section string, option string, value string) bool {
-	c.AddSection(section) // make sure section exists
+// It returns ErrFrozen, leaving the configuration unchanged, if c is frozen.
+func (c *ConfigFile) AddOption(section string, option string, value string) (inserted bool, err error) {
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return false, ErrFrozen
+	}
+	inserted, notify := c.setOption(section, option, value)
+	c.mu.Unlock()
+
+	notify()
+
+	return inserted, nil
+}
+
+// SetByPath has the same behaviour as AddOption for the option named by path, which is
+// split into a section and an option as described for GetByPath.
+func (c *ConfigFile) SetByPath(path string, value string) (inserted bool, err error) {
+	section, option := splitPath(path)
+	return c.AddOption(section, option, value)
+}
+
+// AddOptionStrict has the same behaviour as AddOption but never overwrites a value: it
+// returns an AlreadyExists error, leaving the configuration unchanged, if the section
+// already holds the option. Options of the default section are not considered.
+func (c *ConfigFile) AddOptionStrict(section string, option string, value string) error {
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+	if _, ok := c.data[c.fold(section)][c.fold(option)]; ok {
+		c.mu.Unlock()
+		return GetError{AlreadyExists, "", "", c.fold(section), c.fold(option)}
+	}
+	_, notify := c.setOption(section, option, value)
+	c.mu.Unlock()
 
-	section = strings.ToLower(section)
-	option = strings.ToLower(option)
+	notify()
+
+	return nil
+}
+
+// addOption is AddOption without locking.
+func (c *ConfigFile) addOption(section string, option string, value string) bool {
+	c.addSection(section) // make sure section exists
+
+	section = c.fold(section)
+	option = c.fold(option)
 
 	_, ok := c.data[section][option]
 	c.data[section][option] = value
+	if !ok {
+		c.options[section] = append(c.options[section], option)
+	}
 
 	return !ok
 }
 
+// setOption is addOption, also returning a function that runs the callbacks registered
+// with OnChange for the option. It must be called once the lock is released.
+func (c *ConfigFile) setOption(section string, option string, value string) (inserted bool, notify func()) {
+	old := c.data[c.fold(section)][c.fold(option)]
+	inserted = c.addOption(section, option, value)
+	c.markDirty(section, option)
+	c.setSource(section, option, SourceSet)
+	fns := c.callbacks[c.fold(section)][c.fold(option)]
+
+	return inserted, func() {
+		for _, fn := range fns {
+			fn(old, value)
+		}
+	}
+}
+
+// OnChange registers fn to be called whenever the option in section is set through
+// AddOption (or the typed setters), AppendToOption, CopyOption, SetSection or SetFromMap,
+// after the value is stored.
+// fn receives the previous raw value ("" for a new option) and the new one. Callbacks for
+// the same option run in registration order. They are not called when a configuration is
+// read, merged or reloaded.
+func (c *ConfigFile) OnChange(section string, option string, fn func(old, new string)) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	section = c.fold(section)
+	option = c.fold(option)
+
+	if c.callbacks == nil {
+		c.callbacks = make(map[string]map[string][]func(old, new string))
+	}
+	if c.callbacks[section] == nil {
+		c.callbacks[section] = make(map[string][]func(old, new string))
+	}
+	c.callbacks[section][option] = append(c.callbacks[section][option], fn)
+}
+
+// AppendToOption appends value to the list held by the option, separated by ListSeparator
+// (see GetStringList). If the option does not exist it is set to value, and if the section
+// does not exist it is created.
+func (c *ConfigFile) AppendToOption(section string, option string, value string) error {
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+	if prev, ok := c.data[c.fold(section)][c.fold(option)]; ok {
+		value = prev + c.listSeparator() + value
+	}
+	_, notify := c.setOption(section, option, value)
+	c.mu.Unlock()
+
+	notify()
+
+	return nil
+}
+
+// SetInt has the same behaviour as AddOption but formats an int value.
+func (c *ConfigFile) SetInt(section string, option string, value int) (inserted bool, err error) {
+	return c.AddOption(section, option, strconv.Itoa(value))
+}
+
+// SetBool has the same behaviour as AddOption but formats a bool value as "true" or "false".
+func (c *ConfigFile) SetBool(section string, option string, value bool) (inserted bool, err error) {
+	return c.AddOption(section, option, strconv.FormatBool(value))
+}
+
+// SetFloat64 has the same behaviour as AddOption but formats a float64 value, using the
+// shortest representation that reads back to the same value.
+func (c *ConfigFile) SetFloat64(section string, option string, value float64) (inserted bool, err error) {
+	return c.AddOption(section, option, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// CopyOption copies the raw value of srcOption in srcSection to dstOption in dstSection,
+// creating dstSection if it does not exist. The value is copied without unfolding, so
+// references are resolved in the context of the destination.
+// It returns an error if either the source section or the source option do not exist.
+func (c *ConfigFile) CopyOption(srcSection string, srcOption string, dstSection string, dstOption string) error {
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+	value, err := c.getRawString(srcSection, srcOption)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	_, notify := c.setOption(dstSection, dstOption, value)
+	c.mu.Unlock()
+
+	notify()
+
+	return nil
+}
+
 // RemoveOption removes a option and value from the configuration.
-// It returns true if the option and value were removed, and false otherwise,
-// including if the section did not exist.
-func (c *ConfigFile) RemoveOption(section string, option string) bool {
-	section = strings.ToLower(section)
-	option = strings.ToLower(option)
+// It returns true if the option and value were removed, and false if the option did not exist.
+// It returns an error if the section does not exist.
+func (c *ConfigFile) RemoveOption(section string, option string) (removed bool, err error) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return false, ErrFrozen
+	}
+
+	section = c.fold(section)
+	option = c.fold(option)
 
 	if _, ok := c.data[section]; !ok {
-		return false
+		return false, GetError{SectionNotFound, "", "", section, option}
 	}
 
+	return c.removeOption(section, option), nil
+}
+
+// removeOption is RemoveOption without locking, for an existing section.
+func (c *ConfigFile) removeOption(section string, option string) bool {
+	ok := c.unset(section, option)
+	if ok {
+		c.markDirty(section, option)
+	}
+
+	return ok
+}
+
+// unset removes the option, if it exists, without marking it as changed.
+func (c *ConfigFile) unset(section string, option string) bool {
+	section = c.fold(section)
+	option = c.fold(option)
+
 	_, ok := c.data[section][option]
 	delete(c.data[section], option)
+	if ok {
+		c.options[section] = removeName(c.options[section], option)
+		delete(c.optionComments[section], option)
+		delete(c.sources, OptionRef{section, option})
+	}
 
 	return ok
 }
 
+// GetOrCreateSection returns a copy of the raw options defined in the section itself,
+// creating the section if it does not exist. Changes made to the returned map do not
+// affect the configuration; pass it to SetSection to store them. It returns ErrFrozen
+// if c is frozen and the section does not exist.
+func (c *ConfigFile) GetOrCreateSection(section string) (map[string]string, error) {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.data[c.fold(section)]; !ok && c.frozen {
+		return nil, ErrFrozen
+	}
+	c.addSection(section)
+	section = c.fold(section)
+
+	options := make(map[string]string, len(c.data[section]))
+	for option, value := range c.data[section] {
+		options[option] = value
+	}
+
+	return options, nil
+}
+
+// SetSection replaces the options of the section with kv, creating the section if it does
+// not exist: options in kv overwrite existing ones, and options of the section missing
+// from kv are removed. Existing options keep their position; new ones are added in
+// sorted order. It returns ErrFrozen, leaving the configuration unchanged, if c is frozen.
+func (c *ConfigFile) SetSection(section string, kv map[string]string) error {
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+	c.addSection(section)
+
+	keep := make(map[string]bool, len(kv))
+	names := make([]string, 0, len(kv))
+	for option := range kv {
+		keep[c.fold(option)] = true
+		names = append(names, option)
+	}
+	sort.Strings(names)
+
+	for _, option := range append([]string(nil), c.options[c.fold(section)]...) {
+		if !keep[option] {
+			c.removeOption(section, option)
+		}
+	}
+	var notify []func()
+	for _, option := range names {
+		_, fn := c.setOption(section, option, kv[option])
+		notify = append(notify, fn)
+	}
+	c.mu.Unlock()
+
+	for _, fn := range notify {
+		fn()
+	}
+
+	return nil
+}
+
+// SetSectionComment sets the comment written before the section header, replacing any
+// comment read from a file. Every line of comment is prefixed with the first of
+// CommentChars; an empty comment clears it. It returns an error if the section does not exist.
+func (c *ConfigFile) SetSectionComment(section string, comment string) error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	section = c.fold(section)
+
+	if _, ok := c.data[section]; !ok {
+		return GetError{SectionNotFound, "", "", section, ""}
+	}
+
+	c.sectionComments[section] = c.commentLines(comment)
+
+	return nil
+}
+
+// SetOptionComment sets the comment written before the option, as SetSectionComment does
+// for sections. It returns an error if either the section or the option do not exist.
+func (c *ConfigFile) SetOptionComment(section string, option string, comment string) error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	section = c.fold(section)
+	option = c.fold(option)
+
+	if _, ok := c.data[section]; !ok {
+		return GetError{SectionNotFound, "", "", section, option}
+	}
+	if _, ok := c.data[section][option]; !ok {
+		return GetError{OptionNotFound, "", "", section, option}
+	}
+
+	c.setOptionComments(section, option, c.commentLines(comment))
+
+	return nil
+}
+
+// commentLines turns comment into comment lines starting with the primary comment marker.
+func (c *ConfigFile) commentLines(comment string) (lines []string) {
+	if comment == "" {
+		return nil
+	}
+
+	marker := c.commentChars()[0]
+	for _, l := range strings.Split(comment, "\n") {
+		lines = append(lines, strings.TrimRight(marker+" "+l, " "))
+	}
+
+	return lines
+}
+
+// SetFromMap sets every option of values, which maps sections to options to values,
+// creating the sections as needed, under a single lock: concurrent readers see either
+// none or all of the changes. Options not mentioned keep their value; it is an upsert,
+// not a replacement (see SetSection). Sections, and options within a section, are set in
+// sorted order. All the names are checked first: if one is invalid (see validName),
+// nothing is set and a CouldNotParse error naming it is returned.
+func (c *ConfigFile) SetFromMap(values map[string]map[string]string) error {
+	sections := make([]string, 0, len(values))
+	for section, options := range values {
+		if !validName(section) {
+			return GetError{CouldNotParse, "section name", section, section, ""}
+		}
+		for option := range options {
+			if !validName(option) || strings.ContainsAny(option, string(c.delimiters())) {
+				return GetError{CouldNotParse, "option name", option, section, option}
+			}
+		}
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	c.lock()
+	if c.frozen {
+		c.mu.Unlock()
+		return ErrFrozen
+	}
+	var notify []func()
+	for _, section := range sections {
+		c.addSection(section)
+		options := make([]string, 0, len(values[section]))
+		for option := range values[section] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			_, fn := c.setOption(section, option, values[section][option])
+			notify = append(notify, fn)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, fn := range notify {
+		fn()
+	}
+
+	return nil
+}
+
+// validName reports whether name can be written as a section or option name and read
+// back: it must not be empty or blank, hold a newline or a bracket, or start or end with
+// whitespace.
+func validName(name string) bool {
+	return name != "" && name == strings.TrimSpace(name) && !strings.ContainsAny(name, "\n[]")
+}
+
+// Merge folds every section and option of other into the configuration.
+// Options defined in other take precedence and overwrite existing values; sections
+// missing from the configuration are created. The default section of other is merged
+// into the default section of the configuration. Options that other does not mention
+// are left untouched, and options of other set to UnsetValue, if set, are removed.
+func (c *ConfigFile) Merge(other *ConfigFile) error {
+	other = other.Copy() // snapshot, so that only one lock is held at a time
+
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	for _, section := range other.sections {
+		c.addSection(section)
+		for _, option := range other.options[section] {
+			if c.UnsetValue != "" && other.data[section][option] == c.UnsetValue {
+				c.removeOption(section, option)
+				continue
+			}
+			c.addOption(section, option, other.data[section][option])
+			c.markDirty(section, option)
+			c.setSource(section, option, other.sources[OptionRef{section, option}])
+		}
+	}
+
+	return nil
+}
+
+// Dirty lists the options set or removed since the configuration was created or read,
+// through AddOption and the other setters, RemoveOption, RemoveSection, RenameSection
+// (both the old and the new names), Merge or ImportEnviron, sorted by section and option.
+// An option set back to its original value is still listed. Reading a file does not mark
+// options, and Reload clears the list.
+func (c *ConfigFile) Dirty() []OptionRef {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	refs := make([]OptionRef, 0, len(c.dirty))
+	for ref := range c.dirty {
+		refs = append(refs, ref)
+	}
+	sort.Sort(optionRefs(refs))
+
+	return refs
+}
+
+// ClearDirty empties the list returned by Dirty, e.g. once the changes were saved.
+func (c *ConfigFile) ClearDirty() {
+	c.lock()
+	defer c.mu.Unlock()
+
+	c.dirty = nil
+}
+
+// setSource records where the value of the option came from, for GetStringSource.
+func (c *ConfigFile) setSource(section string, option string, source string) {
+	if c.sources == nil {
+		c.sources = make(map[OptionRef]string)
+	}
+	c.sources[OptionRef{c.fold(section), c.fold(option)}] = source
+}
+
+// markDirty records that the option was changed, for Dirty.
+func (c *ConfigFile) markDirty(section string, option string) {
+	if c.dirty == nil {
+		c.dirty = make(map[OptionRef]bool)
+	}
+	c.dirty[OptionRef{c.fold(section), c.fold(option)}] = true
+}
+
+// optionRefs sorts option references by section, then option.
+type optionRefs []OptionRef
+
+func (r optionRefs) Len() int      { return len(r) }
+func (r optionRefs) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r optionRefs) Less(i, j int) bool {
+	if r[i].Section != r[j].Section {
+		return r[i].Section < r[j].Section
+	}
+	return r[i].Option < r[j].Option
+}
+
+// Copy returns a deep copy of the configuration, including its settings such as
+// ListSeparator. Changes made to the copy never affect the original.
+func (c *ConfigFile) Copy() *ConfigFile {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.clone()
+}
+
+// clone is Copy without locking.
+func (c *ConfigFile) clone() *ConfigFile {
+	n := c.empty()
+	n.data = make(map[string]ConfigSection, len(c.data))
+	n.sections = append([]string(nil), c.sections...)
+	n.options = make(map[string][]string, len(c.options))
+	n.sectionComments = make(map[string][]string, len(c.sectionComments))
+	n.optionComments = make(map[string]map[string][]string, len(c.optionComments))
+	n.header = append([]string(nil), c.header...)
+	n.footer = append([]string(nil), c.footer...)
+	n.arrays = make(map[string][]string, len(c.arrays))
+
+	for section, options := range c.data {
+		n.data[section] = make(ConfigSection, len(options))
+		for option, value := range options {
+			n.data[section][option] = value
+		}
+		n.options[section] = append([]string(nil), c.options[section]...)
+	}
+	for name, sections := range c.arrays {
+		n.arrays[name] = append([]string(nil), sections...)
+	}
+	for section, lines := range c.sectionComments {
+		n.sectionComments[section] = append([]string(nil), lines...)
+	}
+	for section, options := range c.optionComments {
+		n.optionComments[section] = make(map[string][]string, len(options))
+		for option, lines := range options {
+			n.optionComments[section][option] = append([]string(nil), lines...)
+		}
+	}
+	for ref := range c.dirty {
+		n.markDirty(ref.Section, ref.Option)
+	}
+	for ref, source := range c.sources {
+		n.setSource(ref.Section, ref.Option, source)
+	}
+
+	return n
+}
+
+// Resolve returns a copy of the configuration in which every value is unfolded, so that
+// it holds no more %(name)s references. The configuration itself is unchanged.
+// It fails on the first value that cannot be unfolded, naming its section and option.
+// The error wraps the GetError of that value, which errors.As recovers.
+func (c *ConfigFile) Resolve() (*ConfigFile, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	n := c.clone()
+	for _, section := range c.sections {
+		for _, option := range c.options[section] {
+			value, err := c.expand(section, option, c.data[section][option])
+			if err != nil {
+				return nil, fmt.Errorf("section '%s', option '%s': %w", section, option, err)
+			}
+			n.data[section][option] = value
+		}
+	}
+
+	return n, nil
+}
+
+// empty returns an empty configuration with the same settings as c.
+func (c *ConfigFile) empty() *ConfigFile {
+	n := NewConfigFile()
+	n.ListSeparator = c.ListSeparator
+	n.ExpandEnv = c.ExpandEnv
+	n.CaseSensitive = c.CaseSensitive
+	n.Delimiters = append([]byte(nil), c.Delimiters...)
+	n.CommentChars = append([]string(nil), c.CommentChars...)
+	n.InlineComments = c.InlineComments
+	n.StrictDuplicates = c.StrictDuplicates
+	n.EnvironSeparator = c.EnvironSeparator
+	n.QuoteValues = c.QuoteValues
+	n.SortOnWrite = c.SortOnWrite
+	n.IncludeDirective = c.IncludeDirective
+	n.TrimValues = c.TrimValues
+	n.EnableCache = c.EnableCache
+	n.UnsetValue = c.UnsetValue
+	n.OmitDefault = c.OmitDefault
+	n.AllowRepeatedKeys = c.AllowRepeatedKeys
+
+	return n
+}
+
 // NewConfigFile creates an empty configuration representation.
 // This representation can be filled with AddSection and AddOption and then
 // saved to a file using WriteConfigFile.
 func NewConfigFile() *ConfigFile {
 	c := new(ConfigFile)
+	c.ListSeparator = DefaultListSeparator
+	c.Delimiters = append([]byte(nil), DefaultDelimiters...)
+	c.CommentChars = append([]string(nil), DefaultCommentChars...)
+	c.reset()
+
+	return c
+}
+
+// Clear removes every section, option and comment, leaving only the empty default
+// section, and clears the list of changed options (see Dirty). The settings, such as
+// ListSeparator or Delimiters, and the callbacks registered with OnChange are kept.
+// It returns ErrFrozen if c is frozen.
+func (c *ConfigFile) Clear() error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	c.reset()
+
+	return nil
+}
+
+// reset is Clear without locking.
+func (c *ConfigFile) reset() {
 	c.data = make(map[string]ConfigSection)
+	c.sections = nil
+	c.options = make(map[string][]string)
+	c.sectionComments = make(map[string][]string)
+	c.optionComments = make(map[string]map[string][]string)
+	c.header = nil
+	c.footer = nil
+	c.arrays = make(map[string][]string)
+	c.dirty = nil
+	c.sources = nil
 
-	c.AddSection(DefaultSection) // default section always exists
+	c.addSection(DefaultSection) // default section always exists
+}
 
-	return c
+// blank reports whether c holds nothing but the empty default section, as after reset.
+func (c *ConfigFile) blank() bool {
+	return len(c.sections) == 1 && len(c.data[DefaultSection]) == 0 && len(c.sectionComments) == 0 &&
+		c.header == nil && c.footer == nil
+}
+
+// ErrFrozen is returned by the methods changing a configuration once Freeze was called.
+var ErrFrozen = errors.New("conf: configuration is frozen")
+
+// Freeze makes the configuration read-only. From then on, the methods changing its
+// contents, such as AddOption, RemoveSection, SetSection, Clear, Merge or ReadFrom,
+// leave it unchanged and return ErrFrozen; GetOrCreateSection only does so if the
+// section does not exist. The getters and the writers work as before, still taking the
+// read lock. The settings, such as ListSeparator, are plain fields and must not be changed
+// either. A configuration made by Copy or Resolve is not frozen.
+func (c *ConfigFile) Freeze() {
+	c.lock()
+	defer c.mu.Unlock()
+
+	c.frozen = true
+}
+
+// Frozen reports whether Freeze was called.
+func (c *ConfigFile) Frozen() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.frozen
+}
+
+// lock acquires the write lock, which every change to the configuration holds, and
+// empties the cache of GetString.
+func (c *ConfigFile) lock() {
+	c.mu.Lock()
+
+	c.cacheMu.Lock()
+	c.cache = nil
+	c.cacheMu.Unlock()
+}
+
+// extends returns section followed by the sections it extends (see ExtendsOption),
+// nearest first. section must be folded. It returns an InheritanceCycle error if the
+// sections extend each other.
+func (c *ConfigFile) extends(section string) ([]string, error) {
+	path := []string{section}
+	for {
+		parent, ok := c.data[section][ExtendsOption]
+		if !ok {
+			return path, nil
+		}
+		section = c.fold(strings.TrimSpace(parent))
+		for _, s := range path {
+			if s == section {
+				chain := strings.Join(append(path, section), " -> ")
+				return nil, GetError{InheritanceCycle, "", chain, path[0], ""}
+			}
+		}
+		path = append(path, section)
+	}
+}
+
+// visible returns the sections whose options section sees, nearest first: section, the
+// sections it extends, and the default section. section must be folded.
+func (c *ConfigFile) visible(section string) ([]string, error) {
+	path, err := c.extends(section)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range path {
+		if s == DefaultSection {
+			return path, nil
+		}
+	}
+	return append(path, DefaultSection), nil
+}
+
+// extended returns the section defining option among section and the sections it
+// extends, nearest first, or "" if none does. Both names must be folded.
+// This is where the getters read an option from (see ExtendsOption).
+func (c *ConfigFile) extended(section string, option string) (string, error) {
+	if _, ok := c.data[section][option]; ok {
+		return section, nil
+	}
+	if option == ExtendsOption {
+		return "", nil
+	}
+	path, err := c.extends(section)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range path[1:] {
+		if _, ok := c.data[s][option]; ok {
+			return s, nil
+		}
+	}
+	return "", nil
+}
+
+// fold returns the section or option name as stored in the configuration:
+// lower-cased, unless CaseSensitive is set.
+func (c *ConfigFile) fold(name string) string {
+	if c.CaseSensitive {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// listSeparator returns the separator between list elements.
+func (c *ConfigFile) listSeparator() string {
+	if c.ListSeparator == "" {
+		return DefaultListSeparator
+	}
+	return c.ListSeparator
+}
+
+// removeName returns names without the first occurrence of name, preserving order.
+func removeName(names []string, name string) []string {
+	for i, n := range names {
+		if n == name {
+			return append(names[:i], names[i+1:]...)
+		}
+	}
+	return names
+}
+
+// delimiters returns the characters separating an option from its value.
+func (c *ConfigFile) delimiters() []byte {
+	if len(c.Delimiters) == 0 {
+		return DefaultDelimiters
+	}
+	return c.Delimiters
+}
+
+// commentChars returns the markers starting a comment line.
+func (c *ConfigFile) commentChars() []string {
+	if len(c.CommentChars) == 0 {
+		return DefaultCommentChars
+	}
+	return c.CommentChars
+}
+
+// isComment reports whether the line l, without leading whitespace, is a comment.
+func (c *ConfigFile) isComment(l string) bool {
+	return c.commentMarker(l) != ""
+}
+
+// commentMarker returns the CommentChars marker s starts with, or "".
+func (c *ConfigFile) commentMarker(s string) string {
+	for _, m := range c.commentChars() {
+		if m != "" && len(s) >= len(m) && strings.EqualFold(s[:len(m)], m) {
+			return s[:len(m)]
+		}
+	}
+	return ""
 }
 
+var reasonStrings = map[Reason]string{
+	SectionNotFound:   "section not found",
+	OptionNotFound:    "option not found",
+	MaxDepthReached:   "maximum unfolding depth reached",
+	BlankSection:      "empty section name",
+	CouldNotParse:     "could not parse value",
+	AlreadyExists:     "already exists",
+	ProtectedSection:  "protected section",
+	DuplicateSection:  "duplicate section",
+	DuplicateOption:   "duplicate option",
+	MalformedSection:  "malformed section header",
+	UnterminatedQuote: "unterminated quote",
+	InheritanceCycle:  "inheritance cycle",
+}
+
+// String returns a short description of the reason, e.g. "option not found".
+func (r Reason) String() string {
+	if s, ok := reasonStrings[r]; ok {
+		return s
+	}
+	return "Reason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// GetError is returned by the getters. For MaxDepthReached errors caused by a cycle,
+// Value holds the chain of options involved, e.g. "a -> b -> a", and for InheritanceCycle
+// errors the chain of sections, e.g. "prod -> base -> prod".
 type GetError struct {
-	Reason    int
+	Reason    Reason
 	ValueType string
 	Value     string
 	Section   string
@@ -171,26 +1206,88 @@ func (err GetError) Error() string {
 	case OptionNotFound:
 		return fmt.Sprintf("option '%s' not found in section '%s'", string(err.Option), string(err.Section))
 	case CouldNotParse:
+		if err.Option != "" {
+			return fmt.Sprintf("could not parse %s value '%s' of option '%s' in section '%s'",
+				string(err.ValueType), string(err.Value), string(err.Option), string(err.Section))
+		}
 		return fmt.Sprintf("could not parse %s value '%s'", string(err.ValueType), string(err.Value))
+	case AlreadyExists:
+		if err.Option != "" {
+			return fmt.Sprintf("option '%s' already exists in section '%s'", string(err.Option), string(err.Section))
+		}
+		return fmt.Sprintf("section '%s' already exists", string(err.Section))
+	case InheritanceCycle:
+		return fmt.Sprintf("cycle in the sections extended by section '%s': %s", string(err.Section), string(err.Value))
+	case ProtectedSection:
+		return fmt.Sprintf("section '%s' cannot be renamed or removed", string(err.Section))
 	case MaxDepthReached:
-		return fmt.Sprintf("possible cycle while unfolding variables: max depth of %d reached", int(DepthValues))
+		if err.Value != "" {
+			return fmt.Sprintf("cycle while unfolding variables: %s", string(err.Value))
+		}
+		return fmt.Sprintf("possible cycle while unfolding option '%s' in section '%s': max depth reached",
+			string(err.Option), string(err.Section))
 	}
 
-	return "invalid get error"
+	return fmt.Sprintf("%s: option '%s' in section '%s'", err.Reason, string(err.Option), string(err.Section))
 }
 
 type ReadError struct {
-	Reason int
-	Line   string
+	Reason  Reason
+	Line    string
+	LineNo  int    // 1-based number of the offending line.
+	Section string // Section being read, if any.
+	Option  string // Option being read, if any.
+	File    string // Name of the file being read, if known.
 }
 
 func (err ReadError) Error() string {
+	if err.File != "" {
+		file := err.File
+		err.File = ""
+		return file + ", " + err.Error()
+	}
+
 	switch err.Reason {
 	case BlankSection:
-		return "empty section name not allowed"
+		return fmt.Sprintf("line %d: empty section name not allowed", err.LineNo)
 	case CouldNotParse:
-		return fmt.Sprintf("could not parse line: %s", string(err.Line))
+		return fmt.Sprintf("line %d: could not parse line, no delimiter found: %s", err.LineNo, string(err.Line))
+	case MalformedSection:
+		return fmt.Sprintf("line %d: malformed section header: %s", err.LineNo, string(err.Line))
+	case UnterminatedQuote:
+		return fmt.Sprintf("line %d: unterminated quote in value of option '%s': %s", err.LineNo, string(err.Option), string(err.Line))
+	case DuplicateSection:
+		return fmt.Sprintf("line %d: duplicate section '%s'", err.LineNo, string(err.Section))
+	case DuplicateOption:
+		return fmt.Sprintf("line %d: duplicate option '%s' in section '%s'", err.LineNo, string(err.Option), string(err.Section))
 	}
 
-	return "invalid read error"
+	return fmt.Sprintf("line %d: %s: %s", err.LineNo, err.Reason, string(err.Line))
+}
+
+// IncludeCycleError is returned by the reader when a file includes itself, directly or not.
+type IncludeCycleError struct {
+	Files []string // The files including each other, the first one repeated last.
+}
+
+func (err IncludeCycleError) Error() string {
+	return "include cycle: " + strings.Join(err.Files, " -> ")
+}
+
+// MultiError lists several errors, such as the violations found by Validate.
+// It is a slice, so the errors can also be ranged over directly.
+type MultiError []error
+
+// Errors returns the errors listed.
+func (err MultiError) Errors() []error {
+	return []error(err)
+}
+
+// Error lists the errors, one per line.
+func (err MultiError) Error() string {
+	lines := make([]string, len(err))
+	for i, e := range err {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
 }
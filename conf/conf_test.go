@@ -1,8 +1,19 @@
 package conf
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 const confFile = `
@@ -14,10 +25,9 @@ active = false
 
 [service-1]
 port = 443
+url = http://%(host)s/something
 `
 
-//url = http://%(host)s/something
-
 type stringtest struct {
 	section string
 	option  string
@@ -42,7 +52,7 @@ var testSet = []interface{}{
 	booltest{"default", "compression", true},
 	booltest{"default", "active", false},
 	inttest{"service-1", "port", 443},
-	//stringtest{"service-1", "url", "http://example.com/something"},
+	stringtest{"service-1", "url", "http://example.com/something"},
 }
 
 func TestBuild(t *testing.T) {
@@ -80,3 +90,2600 @@ func TestBuild(t *testing.T) {
 		}
 	}
 }
+
+func TestGetInt64(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "big", "9007199254740993")
+	c.AddOption("default", "negative", "-42")
+
+	if v, err := c.GetInt64("", "big"); err != nil || v != 9007199254740993 {
+		t.Errorf("c.GetInt64(\"\",\"big\") returned %d, %v", v, err)
+	}
+	if v, err := c.GetInt64("", "negative"); err != nil || v != -42 {
+		t.Errorf("c.GetInt64(\"\",\"negative\") returned %d, %v", v, err)
+	}
+	if v, err := c.GetUint64("", "big"); err != nil || v != 9007199254740993 {
+		t.Errorf("c.GetUint64(\"\",\"big\") returned %d, %v", v, err)
+	}
+	_, err := c.GetUint64("", "negative")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse {
+		t.Errorf("c.GetUint64(\"\",\"negative\") returned error %v, want CouldNotParse", err)
+	}
+}
+
+func TestGetStringDefault(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := c.GetStringDefault("", "host", "fallback"); err != nil || v != "example.com" {
+		t.Errorf("c.GetStringDefault(\"\",\"host\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetStringDefault("", "missing", "fallback"); err != nil || v != "fallback" {
+		t.Errorf("c.GetStringDefault(\"\",\"missing\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetStringDefault("missing", "host", "fallback"); err != nil || v != "fallback" {
+		t.Errorf("c.GetStringDefault(\"missing\",\"host\") returned %q, %v", v, err)
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "timeout", "1m30s")
+	c.AddOption("default", "bare", "30")
+
+	if v, err := c.GetDuration("", "timeout"); err != nil || v != 90*time.Second {
+		t.Errorf("c.GetDuration(\"\",\"timeout\") returned %v, %v", v, err)
+	}
+	_, err := c.GetDuration("", "bare")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse {
+		t.Errorf("c.GetDuration(\"\",\"bare\") returned error %v, want CouldNotParse", err)
+	}
+}
+
+func TestGetStringList(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "names", " alpha, beta,, gamma ,")
+	c.AddOption("default", "blank", "   ")
+
+	list, err := c.GetStringList("", "names")
+	if err != nil || strings.Join(list, "|") != "alpha|beta|gamma" {
+		t.Errorf("c.GetStringList(\"\",\"names\") returned %q, %v", list, err)
+	}
+	list, err = c.GetStringList("", "blank")
+	if err != nil || list == nil || len(list) != 0 {
+		t.Errorf("c.GetStringList(\"\",\"blank\") returned %q, %v", list, err)
+	}
+}
+
+func TestListSeparator(t *testing.T) {
+	c := NewConfigFile()
+	c.ListSeparator = "||"
+	c.AddOption("default", "rows", "a,b || c,d||e")
+
+	list, err := c.GetStringList("", "rows")
+	if err != nil || strings.Join(list, "|") != "a,b|c,d|e" {
+		t.Errorf("c.GetStringList(\"\",\"rows\") returned %q, %v", list, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override := NewConfigFile()
+	override.AddOption("default", "port", "8080")
+	override.AddOption("service-2", "host", "s2.example.com")
+
+	if err = base.Merge(override); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := base.GetInt("", "port"); v != 8080 {
+		t.Errorf("merged port is %d, want 8080", v)
+	}
+	if v, _ := base.GetString("", "host"); v != "example.com" {
+		t.Errorf("merged host is %q, want example.com", v)
+	}
+	if v, _ := base.GetString("service-2", "host"); v != "s2.example.com" {
+		t.Errorf("merged service-2 host is %q, want s2.example.com", v)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ListSeparator = ";"
+
+	n := c.Copy()
+	n.AddOption("default", "host", "changed.example.com")
+	n.RemoveSection("service-1")
+
+	if v, _ := c.GetString("", "host"); v != "example.com" {
+		t.Errorf("original host is %q after changing the copy", v)
+	}
+	if !c.HasSection("service-1") {
+		t.Error("original lost section service-1 after removing it from the copy")
+	}
+	if n.ListSeparator != ";" {
+		t.Errorf("copy has ListSeparator %q, want \";\"", n.ListSeparator)
+	}
+}
+
+func TestInsertionOrder(t *testing.T) {
+	c := NewConfigFile()
+	for _, s := range []string{"zeta", "alpha", "mid"} {
+		c.AddSection(s)
+	}
+	for _, o := range []string{"z", "a", "m"} {
+		c.AddOption("mid", o, "1")
+	}
+	c.RemoveSection("alpha")
+	if added, _ := c.AddSection("alpha"); !added {
+		t.Error("c.AddSection() did not report that the section was created")
+	}
+	if added, _ := c.AddSection("Alpha"); added {
+		t.Error("c.AddSection() did not report whether the section was created")
+	}
+	c.RemoveOption("mid", "z")
+	c.AddOption("mid", "z", "2")
+
+	if s := strings.Join(c.GetSections(), ","); s != "default,zeta,mid,alpha" {
+		t.Errorf("c.GetSections() returned %s", s)
+	}
+	options, err := c.GetOptions("mid")
+	if err != nil || strings.Join(options, ",") != "a,m,z" {
+		t.Errorf("c.GetOptions(\"mid\") returned %q, %v", options, err)
+	}
+
+	c.AddOption("default", "host", "localhost")
+	if options, _ = c.GetOptions(""); strings.Join(options, ",") != "host" {
+		t.Errorf("c.GetOptions(\"\") returned %q", options)
+	}
+}
+
+func TestAddSectionIfNotExists(t *testing.T) {
+	c := NewConfigFile()
+	if !c.AddSectionIfNotExists("Cache") {
+		t.Error("AddSectionIfNotExists(Cache) of a new section returned false")
+	}
+	if c.AddSectionIfNotExists("cache") || c.AddSectionIfNotExists("default") {
+		t.Error("AddSectionIfNotExists of an existing section returned true")
+	}
+	if !c.HasSection("cache") || len(c.GetSections()) != 2 {
+		t.Errorf("sections are %v, want default and cache", c.GetSections())
+	}
+
+	c.Freeze()
+	if c.AddSectionIfNotExists("db") || c.HasSection("db") {
+		t.Error("AddSectionIfNotExists created a section in a frozen configuration")
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddOption("service-0", "host", "s0.example.com")
+
+	buf := bytes.NewBuffer(nil)
+	n, err := c.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("c.WriteTo() reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	want := "host=example.com\nport=43\ncompression=on\nactive=false\n\n" +
+		"[service-1]\nport=443\nurl=http://%(host)s/something\n\n" +
+		"[service-0]\nhost=s0.example.com\n\n"
+	if buf.String() != want {
+		t.Errorf("c.WriteTo() wrote:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	r, err := ReadConfigBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.GetInt("service-1", "port"); v != 443 {
+		t.Errorf("re-read service-1 port is %d, want 443", v)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	c := NewConfigFile()
+	n, err := c.ReadFrom(strings.NewReader(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(confFile)) {
+		t.Errorf("c.ReadFrom() reported %d bytes, want %d", n, len(confFile))
+	}
+
+	_, err = NewConfigFile().ReadFrom(strings.NewReader("a = 1\n[s]\n\nmalformed\n"))
+	if e, ok := err.(ReadError); !ok || e.Reason != CouldNotParse || e.LineNo != 4 {
+		t.Errorf("c.ReadFrom() returned error %v, want CouldNotParse on line 4", err)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GOCONF_TEST_HOME", "/home/goconf")
+	os.Unsetenv("GOCONF_TEST_UNSET")
+
+	c := NewConfigFile()
+	c.AddOption("default", "data", "${GOCONF_TEST_HOME}/data:${GOCONF_TEST_UNSET}")
+
+	if v, _ := c.GetString("", "data"); v != "${GOCONF_TEST_HOME}/data:${GOCONF_TEST_UNSET}" {
+		t.Errorf("c.GetString(\"\",\"data\") expanded without ExpandEnv: %q", v)
+	}
+	c.ExpandEnv = true
+	if v, _ := c.GetString("", "data"); v != "/home/goconf/data:${GOCONF_TEST_UNSET}" {
+		t.Errorf("c.GetString(\"\",\"data\") returned %q", v)
+	}
+}
+
+func TestEscapedPercent(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "id", "42")
+	c.AddOption("default", "path", "/items/%(id)s?fmt=%%(id)s&pct=100%%")
+	c.AddOption("default", "cycle", "%(cycle)s")
+
+	if v, err := c.GetString("", "path"); err != nil || v != "/items/42?fmt=%(id)s&pct=100%" {
+		t.Errorf("c.GetString(\"\",\"path\") returned %q, %v", v, err)
+	}
+	if v, _ := c.GetRawString("", "path"); v != "/items/%(id)s?fmt=%%(id)s&pct=100%%" {
+		t.Errorf("c.GetRawString(\"\",\"path\") returned %q", v)
+	}
+	_, err := c.GetString("", "cycle")
+	if e, ok := err.(GetError); !ok || e.Reason != MaxDepthReached {
+		t.Errorf("c.GetString(\"\",\"cycle\") returned error %v, want MaxDepthReached", err)
+	}
+}
+
+func TestUnfoldCycle(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "a", "%(b)s")
+	c.AddOption("default", "b", "x%(c)s")
+	c.AddOption("default", "c", "%(a)s")
+	c.AddOption("default", "twice", "%(d)s%(d)s")
+	c.AddOption("default", "d", "d")
+
+	_, err := c.GetString("", "a")
+	if e, ok := err.(GetError); !ok || e.Reason != MaxDepthReached || e.Value != "a -> b -> c -> a" {
+		t.Errorf("c.GetString(\"\",\"a\") returned error %#v, want cycle a -> b -> c -> a", err)
+	}
+	if v, err := c.GetString("", "twice"); err != nil || v != "dd" {
+		t.Errorf("c.GetString(\"\",\"twice\") returned %q, %v", v, err)
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	const mixedCase = "Host = upper\nhost = lower\n[Service]\nPort = 1\n"
+
+	folded := NewConfigFile()
+	if err := folded.Read(strings.NewReader(mixedCase)); err != nil {
+		t.Fatal(err)
+	}
+	sensitive := NewConfigFile()
+	sensitive.CaseSensitive = true
+	if err := sensitive.Read(strings.NewReader(mixedCase)); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := folded.GetString("", "Host"); v != "lower" {
+		t.Errorf("folded Host is %q, want lower", v)
+	}
+	if v, _ := sensitive.GetString("", "Host"); v != "upper" {
+		t.Errorf("case-sensitive Host is %q, want upper", v)
+	}
+	if !folded.HasOption("service", "port") {
+		t.Error("folded configuration has no option service/port")
+	}
+	if sensitive.HasOption("service", "port") || !sensitive.HasOption("Service", "Port") {
+		t.Error("case-sensitive configuration does not distinguish Service/Port from service/port")
+	}
+}
+
+func TestGetIntSlice(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "ports", "8080, 8081 ,8082")
+	c.AddOption("default", "bad", "8080, eighty, 8082")
+
+	ports, err := c.GetIntSlice("", "ports")
+	if err != nil || len(ports) != 3 || ports[0] != 8080 || ports[2] != 8082 {
+		t.Errorf("c.GetIntSlice(\"\",\"ports\") returned %v, %v", ports, err)
+	}
+	ports, err = c.GetIntSlice("", "bad")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.Value != "eighty" || ports != nil {
+		t.Errorf("c.GetIntSlice(\"\",\"bad\") returned %v, %v", ports, err)
+	}
+}
+
+func TestCopyOption(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("prod", "host", "prod.example.com")
+	c.AddOption("prod", "url", "https://%(host)s/")
+	c.AddOption("staging", "host", "staging.example.com")
+
+	if err := c.CopyOption("prod", "url", "staging", "url"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetRawString("staging", "url"); v != "https://%(host)s/" {
+		t.Errorf("the copied raw value is %q", v)
+	}
+	if v, _ := c.GetString("staging", "url"); v != "https://staging.example.com/" {
+		t.Errorf("the copy unfolds to %q, want the host of the destination", v)
+	}
+
+	if err := c.CopyOption("prod", "host", "Backup", "origin"); err != nil || !c.HasSection("backup") {
+		t.Fatalf("CopyOption to a new section returned %v", err)
+	}
+	if v, _ := c.GetRawString("backup", "origin"); v != "prod.example.com" {
+		t.Errorf("backup.origin = %q", v)
+	}
+
+	for _, e := range []struct {
+		section, option string
+		reason          Reason
+	}{
+		{"missing", "host", SectionNotFound},
+		{"prod", "missing", OptionNotFound},
+	} {
+		err := c.CopyOption(e.section, e.option, "staging", "copy")
+		if ge, ok := err.(GetError); !ok || ge.Reason != e.reason {
+			t.Errorf("CopyOption(%q, %q) returned %v", e.section, e.option, err)
+		}
+	}
+	if c.HasOption("staging", "copy") {
+		t.Error("a failed CopyOption set the destination")
+	}
+}
+
+func TestRenameSection(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddSection("service-2")
+
+	if err = c.RenameSection("service-1", "service-one"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetInt("service-one", "port"); v != 443 || c.HasSection("service-1") {
+		t.Errorf("renamed section has port %d, old section exists: %v", v, c.HasSection("service-1"))
+	}
+	if s := strings.Join(c.GetSections(), ","); s != "default,service-one,service-2" {
+		t.Errorf("c.GetSections() returned %s after rename", s)
+	}
+
+	for _, e := range []struct {
+		oldName, newName string
+		reason           Reason
+	}{
+		{"missing", "other", SectionNotFound},
+		{"service-one", "service-2", AlreadyExists},
+		{"default", "other", ProtectedSection},
+	} {
+		err = c.RenameSection(e.oldName, e.newName)
+		if ge, ok := err.(GetError); !ok || ge.Reason != e.reason {
+			t.Errorf("c.RenameSection(%q, %q) returned error %v", e.oldName, e.newName, err)
+		}
+	}
+
+	if c, err = ReadConfigBytes([]byte("[[server]]\nhost = a\n[[server]]\nhost = b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RenameSection("server.0", "primary"); err != nil {
+		t.Fatal(err)
+	}
+	if list := c.GetSectionList("server"); strings.Join(list, ",") != "server.1" {
+		t.Errorf("GetSectionList(server) = %q after renaming server.0", list)
+	}
+	r, err := ReadConfigBytes(c.WriteConfigBytes(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.GetString("primary", "host"); v != "a" {
+		t.Errorf("the renamed element was not written as a section: primary.host = %q", v)
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	c := NewConfigFile()
+	for _, e := range []struct {
+		value string
+		bytes int64
+	}{
+		{"512", 512},
+		{"512B", 512},
+		{"256KB", 256 << 10},
+		{"4 MB", 4 << 20},
+		{"1gb", 1 << 30},
+		{"2TB", 2 << 40},
+	} {
+		c.AddOption("default", "size", e.value)
+		if v, err := c.GetBytes("", "size"); err != nil || v != e.bytes {
+			t.Errorf("c.GetBytes() of %q returned %d, %v", e.value, v, err)
+		}
+	}
+	for _, value := range []string{"", "MB", "1.5GB", "10XB", "-1KB"} {
+		c.AddOption("default", "size", value)
+		_, err := c.GetBytes("", "size")
+		if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse {
+			t.Errorf("c.GetBytes() of %q returned error %v, want CouldNotParse", value, err)
+		}
+	}
+}
+
+func TestBoolStrings(t *testing.T) {
+	BoolStrings["sure"] = true
+	BoolStrings["nope"] = false
+	defer delete(BoolStrings, "sure")
+	defer delete(BoolStrings, "nope")
+
+	c := NewConfigFile()
+	for value, answer := range map[string]bool{"Enabled": true, "disabled": false, "SURE": true, "nope": false} {
+		c.AddOption("default", "flag", value)
+		if v, err := c.GetBool("", "flag"); err != nil || v != answer {
+			t.Errorf("c.GetBool() of %q returned %v, %v", value, v, err)
+		}
+	}
+}
+
+func TestGetFloat64(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "ratio", "1.5e-3")
+	c.AddOption("default", "garbage", "1.5abc")
+
+	if v, err := c.GetFloat64("", "ratio"); err != nil || v != 0.0015 {
+		t.Errorf("c.GetFloat64(\"\",\"ratio\") returned %v, %v", v, err)
+	}
+	_, err := c.GetFloat64("", "garbage")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "float64" {
+		t.Errorf("c.GetFloat64(\"\",\"garbage\") returned error %v, want CouldNotParse", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Validate([]OptionRule{
+		{"", "host", true, ""},
+		{"", "port", true, "int"},
+		{"", "compression", false, "bool"},
+		{"", "timeout", false, "duration"},
+		{"", "host", false, "int"},
+		{"service-1", "name", true, ""},
+	})
+	violations, ok := err.(MultiError)
+	if !ok || len(violations) != 2 {
+		t.Fatalf("c.Validate() returned %v, want two violations", err)
+	}
+	if e, ok := violations[0].(GetError); !ok || e.Reason != CouldNotParse || e.Option != "host" {
+		t.Errorf("first violation is %v, want host not an int", violations[0])
+	}
+	if e, ok := violations[1].(GetError); !ok || e.Reason != OptionNotFound || e.Option != "name" {
+		t.Errorf("second violation is %v, want missing name", violations[1])
+	}
+}
+
+func TestGetSectionMap(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := c.GetSectionMap("service-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options["port"] != "443" || options["host"] != "example.com" || options["url"] != "http://example.com/something" {
+		t.Errorf("c.GetSectionMap(\"service-1\") returned %v", options)
+	}
+	options["port"] = "1"
+	if v, _ := c.GetInt("service-1", "port"); v != 443 {
+		t.Error("changing the map returned by c.GetSectionMap() changed the configuration")
+	}
+	if _, err = c.GetSectionMap("missing"); err == nil {
+		t.Error("c.GetSectionMap(\"missing\") returned no error")
+	}
+}
+
+func TestRemoveOption(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := c.RemoveOption("default", "host"); !removed || err != nil {
+		t.Errorf("c.RemoveOption(\"default\",\"host\") returned %v, %v", removed, err)
+	}
+	if removed, err := c.RemoveOption("default", "host"); removed || err != nil {
+		t.Errorf("second c.RemoveOption(\"default\",\"host\") returned %v, %v", removed, err)
+	}
+	if options, _ := c.GetOptions("service-1"); strings.Join(options, ",") != "port,compression,active,port,url" {
+		t.Errorf("c.GetOptions(\"service-1\") returned %q after removal", options)
+	}
+	if _, err := c.RemoveOption("missing", "host"); err == nil {
+		t.Error("c.RemoveOption(\"missing\",\"host\") returned no error")
+	}
+}
+
+func TestMultiLineValues(t *testing.T) {
+	const multiLine = "sql = SELECT id, name \\\n      FROM users\n" +
+		"path = C:\\dir\\file\n" +
+		"# see C:\\dir\\\nafter = comment\n" +
+		"key = first\n  next\n  other = x\n    y \\= z\n" +
+		"  [indented]\n  a = 1\n  b = 2\n"
+
+	c, err := ReadConfigBytes([]byte(multiLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for option, answer := range map[string]string{
+		"sql":   "SELECT id, name FROM users",
+		"path":  "C:\\dir\\file",
+		"after": "comment",
+		"key":   "first\nnext",
+		"other": "x\ny = z",
+	} {
+		if v, _ := c.GetRawString("", option); v != answer {
+			t.Errorf("c.GetRawString(\"\",%q) returned %q, want %q", option, v, answer)
+		}
+	}
+	if a, _ := c.GetRawString("indented", "a"); a != "1" || !c.HasOption("indented", "b") {
+		t.Errorf("equally indented options were read as continuations: a = %q", a)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("host = example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := c.WriteConfigBytes("generated")
+	for i := 0; i < 3; i++ {
+		if c, err = ReadConfigBytes(out); err != nil {
+			t.Fatal(err)
+		}
+		out = c.WriteConfigBytes("generated")
+	}
+	if want := "# generated\n\nhost=example.com\n\n"; string(out) != want {
+		t.Errorf("rewriting the configuration wrote:\n%s\nwant:\n%s", out, want)
+	}
+
+	const commented = "# file header\n# second line\n\n# about host\nhost=example.com\n\n"
+	if c, err = ReadConfigBytes([]byte(commented)); err != nil {
+		t.Fatal(err)
+	}
+	if out := string(c.WriteConfigBytes("")); out != commented {
+		t.Errorf("the header of the file was not kept, wrote:\n%s", out)
+	}
+	if out, want := string(c.WriteConfigBytes("new")), "# new\n\n# about host\nhost=example.com\n\n"; out != want {
+		t.Errorf("the header did not replace the one of the file, wrote:\n%s", out)
+	}
+
+	c = NewConfigFile()
+	c.Read(strings.NewReader("host = example.com\n"))
+	c.Read(strings.NewReader("# second file\n\nport = 80\n"))
+	if out := string(c.WriteConfigBytes("")); strings.HasPrefix(out, "# second file") {
+		t.Errorf("the comments of the second file became the header, wrote:\n%s", out)
+	}
+}
+
+func TestCommentRoundTrip(t *testing.T) {
+	const commented = "# global settings\nhost=example.com\n\n; the port\nport=43\n\n" +
+		"# first service\n[service-1]\n# tls port\nport=443\n\n# trailing note\n"
+
+	c, err := ReadConfigBytes([]byte(commented))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := string(c.WriteConfigBytes("")); out != commented {
+		t.Errorf("comments were not preserved, wrote:\n%s", out)
+	}
+
+	c.RemoveOption("default", "port")
+	want := "# global settings\nhost=example.com\n\n" +
+		"# first service\n[service-1]\n# tls port\nport=443\n\n# trailing note\n"
+	if out := string(c.WriteConfigBytes("")); out != want {
+		t.Errorf("comment of a removed option was kept, wrote:\n%s", out)
+	}
+}
+
+func TestTypedSetters(t *testing.T) {
+	c := NewConfigFile()
+	c.SetInt("service", "port", 443)
+	c.SetBool("service", "tls", true)
+	c.SetFloat64("service", "ratio", 0.25)
+
+	if v, err := c.GetInt("service", "port"); err != nil || v != 443 {
+		t.Errorf("c.GetInt() after SetInt returned %d, %v", v, err)
+	}
+	if v, _ := c.GetRawString("service", "tls"); v != "true" {
+		t.Errorf("SetBool stored %q, want true", v)
+	}
+	if v, err := c.GetBool("service", "tls"); err != nil || !v {
+		t.Errorf("c.GetBool() after SetBool returned %v, %v", v, err)
+	}
+	if v, err := c.GetFloat64("service", "ratio"); err != nil || v != 0.25 {
+		t.Errorf("c.GetFloat64() after SetFloat64 returned %v, %v", v, err)
+	}
+}
+
+func TestAppendToOption(t *testing.T) {
+	c := NewConfigFile()
+	for _, v := range []string{"alpha", "beta", "gamma"} {
+		if err := c.AppendToOption("lists", "names", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := c.GetStringList("lists", "names")
+	if err != nil || strings.Join(list, "|") != "alpha|beta|gamma" {
+		t.Errorf("c.GetStringList() after appending returned %q, %v", list, err)
+	}
+}
+
+func TestGetStringMatch(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "level", "debug")
+
+	if v, err := c.GetStringMatch("", "level", "^(debug|info)$"); err != nil || v != "debug" {
+		t.Errorf("c.GetStringMatch() returned %q, %v", v, err)
+	}
+	_, err := c.GetStringMatch("", "level", "^(warn|error)$")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "regexp:^(warn|error)$" {
+		t.Errorf("c.GetStringMatch() returned error %v, want CouldNotParse", err)
+	}
+	if _, err = c.GetStringMatch("", "level", "(unclosed"); err == nil {
+		t.Error("c.GetStringMatch() with an invalid pattern returned no error")
+	}
+}
+
+func TestReadFromSlowReader(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("db", "host", "localhost")
+
+	for name, read := range map[string]func(r io.Reader) error{
+		"ReadFrom":     func(r io.Reader) error { _, err := c.ReadFrom(r); return err },
+		"ReadFromJSON": c.ReadFromJSON,
+	} {
+		pr, pw := io.Pipe()
+		done := make(chan error)
+		go func() { done <- read(pr) }()
+
+		got := make(chan string)
+		go func() {
+			v, _ := c.GetString("db", "host")
+			got <- v
+		}()
+		select {
+		case v := <-got:
+			if v != "localhost" {
+				t.Errorf("GetString during %s returned %q", name, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("GetString blocked while %s waited for its reader", name)
+		}
+
+		if name == "ReadFrom" {
+			io.WriteString(pw, "[db]\nport = 5432\n")
+		} else {
+			io.WriteString(pw, `{"db": {"port": 5432}}`)
+		}
+		pw.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("%s returned %v", name, err)
+		}
+		if v, _ := c.GetInt("db", "port"); v != 5432 {
+			t.Errorf("db.port = %d after %s", v, name)
+		}
+		c.RemoveOption("db", "port")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			c.SetInt("service-1", "port", i)
+			c.AddOption("service-2", "host", "s2.example.com")
+			c.RemoveSection("service-2")
+		}
+		done <- true
+	}()
+	for i := 0; i < 1000; i++ {
+		if _, err := c.GetString("service-1", "url"); err != nil {
+			t.Fatal(err)
+		}
+		c.GetSections()
+		c.HasOption("service-2", "host")
+	}
+	<-done
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.conf")
+	bad := filepath.Join(dir, "bad.conf")
+	ioutil.WriteFile(good, []byte("[reloaded]\nport = 8080\n"), 0644)
+	ioutil.WriteFile(bad, []byte("[reloaded]\nport = 9090\n[broken]\nmalformed\n"), 0644)
+
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Reload(bad); err == nil {
+		t.Fatal("c.Reload() of a malformed file returned no error")
+	}
+	if c.HasSection("reloaded") || !c.HasSection("service-1") {
+		t.Error("failed c.Reload() changed the configuration")
+	}
+	if err = c.Reload(good); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetInt("reloaded", "port"); v != 8080 || c.HasSection("service-1") {
+		t.Errorf("c.Reload() did not replace the configuration, port is %d", v)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	c := NewConfigFile()
+	var calls []string
+	c.OnChange("logging", "level", func(old, new string) {
+		calls = append(calls, "first:"+old+">"+new)
+	})
+	c.OnChange("logging", "level", func(old, new string) {
+		calls = append(calls, "second:"+old+">"+new)
+		c.GetString("logging", "level") // callbacks run without the lock held
+	})
+
+	if err := c.Read(strings.NewReader("[logging]\nlevel = info\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.AddOption("logging", "level", "debug")
+	c.AddOption("logging", "file", "/var/log/app.log")
+
+	if s := strings.Join(calls, ","); s != "first:info>debug,second:info>debug" {
+		t.Errorf("callbacks were called as %s", s)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"default":{"host":"example.com","port":"43","compression":"on","active":"false"},` +
+		`"service-1":{"port":"443","url":"http://example.com/something"}}`
+	if string(b) != want {
+		t.Errorf("json.Marshal() returned %s", b)
+	}
+}
+
+func TestReadFromJSON(t *testing.T) {
+	c := NewConfigFile()
+	err := c.ReadFromJSON(strings.NewReader(`{"default": {"host": "example.com", "port": 43, "tls": true},
+		"service-1": {"ratio": 1.5e-3, "empty": null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []stringtest{
+		{"default", "host", "example.com"},
+		{"default", "port", "43"},
+		{"default", "tls", "true"},
+		{"service-1", "ratio", "1.5e-3"},
+		{"service-1", "empty", ""},
+	} {
+		if v, err := c.GetRawString(e.section, e.option); err != nil || v != e.answer {
+			t.Errorf("c.GetRawString(%q, %q) returned %q, %v", e.section, e.option, v, err)
+		}
+	}
+
+	err = NewConfigFile().ReadFromJSON(strings.NewReader(`{"server": {"tls": {"cert": "x"}}}`))
+	if err == nil || !strings.Contains(err.Error(), "server.tls") {
+		t.Errorf("c.ReadFromJSON() of a nested object returned error %v", err)
+	}
+}
+
+func TestGetStringArray(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "names", `"Doe, John", "Roe, Jane" , plain,, "say \"hi\"", ""`)
+	c.AddOption("default", "unterminated", `"Doe, John", "Roe, Jane`)
+	c.AddOption("default", "admin", `"Poe, Ed`)
+	c.AddOption("default", "team", `%(admin)s, "Doe, John", %(missing:a, b)s`)
+
+	list, err := c.GetStringArray("", "names")
+	if err != nil || strings.Join(list, "|") != `Doe, John|Roe, Jane|plain|say "hi"|` {
+		t.Errorf("c.GetStringArray(\"\",\"names\") returned %q, %v", list, err)
+	}
+	_, err = c.GetStringArray("", "unterminated")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse {
+		t.Errorf("c.GetStringArray(\"\",\"unterminated\") returned error %v, want CouldNotParse", err)
+	}
+	list, err = c.GetStringArray("", "team")
+	if err != nil || strings.Join(list, "|") != `"Poe, Ed|Doe, John|a, b` {
+		t.Errorf("c.GetStringArray(\"\",\"team\") returned %q, %v", list, err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	new := old.Copy()
+	new.AddOption("default", "port", "8080")
+	new.RemoveOption("default", "active")
+	new.RemoveSection("service-1")
+	new.AddOption("service-2", "host", "s2.example.com")
+
+	d := old.Diff(new)
+	if strings.Join(d.AddedSections, ",") != "service-2" || strings.Join(d.RemovedSections, ",") != "service-1" {
+		t.Errorf("sections added %q, removed %q", d.AddedSections, d.RemovedSections)
+	}
+	if len(d.Changed) != 1 || d.Changed[0] != (OptionChange{"default", "port", "43", "8080"}) {
+		t.Errorf("changed options are %v", d.Changed)
+	}
+	if len(d.Removed) != 3 || d.Removed[0] != (OptionChange{"default", "active", "false", ""}) {
+		t.Errorf("removed options are %v", d.Removed)
+	}
+	if len(d.Added) != 1 || d.Added[0] != (OptionChange{"service-2", "host", "", "s2.example.com"}) {
+		t.Errorf("added options are %v", d.Added)
+	}
+	if !old.Diff(old).Empty() {
+		t.Error("a configuration differs from itself")
+	}
+}
+
+func TestGetOptionsLocal(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddSection("empty")
+
+	if options, err := c.GetOptionsLocal("service-1"); err != nil || strings.Join(options, ",") != "port,url" {
+		t.Errorf("c.GetOptionsLocal(\"service-1\") returned %q, %v", options, err)
+	}
+	if options, err := c.GetOptionsLocal("empty"); err != nil || options == nil || len(options) != 0 {
+		t.Errorf("c.GetOptionsLocal(\"empty\") returned %q, %v", options, err)
+	}
+	if _, err := c.GetOptionsLocal("missing"); err == nil {
+		t.Error("c.GetOptionsLocal(\"missing\") returned no error")
+	}
+}
+
+func TestCommentChars(t *testing.T) {
+	c := NewConfigFile()
+	c.CommentChars = []string{"//", "#"}
+	err := c.Read(strings.NewReader("// legacy comment\n  # indented comment\nurl = http://example.com/#top\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options, _ := c.GetOptionsLocal(""); strings.Join(options, ",") != "url" {
+		t.Errorf("comment lines were read as options: %q", options)
+	}
+	if v, _ := c.GetString("", "url"); v != "http://example.com/#top" {
+		t.Errorf("url is %q, want the fragment preserved", v)
+	}
+
+	c = NewConfigFile()
+	c.CommentChars = []string{"//"}
+	c.AddOption("default", "url", "http://example.com/")
+	out := c.WriteConfigBytes("generated")
+	if !strings.HasPrefix(string(out), "// generated\n") {
+		t.Errorf("the header was not written with the comment marker:\n%s", out)
+	}
+	r := NewConfigFile()
+	r.CommentChars = []string{"//"}
+	if err = r.Read(bytes.NewReader(out)); err != nil {
+		t.Errorf("the output could not be read back: %v", err)
+	}
+
+	c = NewConfigFile()
+	c.CommentChars = []string{"#"}
+	if err = c.Read(strings.NewReader("remote = x\n")); err != nil || !c.HasOption("", "remote") {
+		t.Errorf("an option starting with rem was read as a comment: %v", err)
+	}
+	c = NewConfigFile()
+	if err = c.Read(strings.NewReader("REM windows comment\nRem other\nrem\nremote = x\nport = 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if options, _ := c.GetOptionsLocal(""); strings.Join(options, ",") != "port" {
+		t.Errorf("rem lines were read as options: %q", options)
+	}
+	c = NewConfigFile()
+	c.InlineComments = true
+	if err = c.Read(strings.NewReader("plan = premium rem the paid plan\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetString("", "plan"); v != "premium" {
+		t.Errorf("inline rem comment left plan = %q, want premium", v)
+	}
+}
+
+func TestInlineComments(t *testing.T) {
+	const inline = "port = 8080 ; the http port\nurl = http://example.com/#top\n" +
+		"quoted = \"a ; b\" # comment\nescaped = a\\;b\n"
+
+	c := NewConfigFile()
+	c.InlineComments = true
+	if err := c.Read(strings.NewReader(inline)); err != nil {
+		t.Fatal(err)
+	}
+	for option, answer := range map[string]string{
+		"port":    "8080",
+		"url":     "http://example.com/",
+		"quoted":  "\"a ; b\"",
+		"escaped": "a;b",
+	} {
+		if v, _ := c.GetRawString("", option); v != answer {
+			t.Errorf("c.GetRawString(\"\",%q) returned %q, want %q", option, v, answer)
+		}
+	}
+
+	c = NewConfigFile()
+	if err := c.Read(strings.NewReader(inline)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetRawString("", "url"); v != "http://example.com/#top" {
+		t.Errorf("url is %q without InlineComments", v)
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.GetAll("service-1", "port")
+	if err != nil || r != (Resolution{"443", true, "43", true, "443"}) {
+		t.Errorf("c.GetAll(\"service-1\",\"port\") returned %+v, %v", r, err)
+	}
+	r, err = c.GetAll("service-1", "host")
+	if err != nil || r != (Resolution{"", false, "example.com", true, "example.com"}) {
+		t.Errorf("c.GetAll(\"service-1\",\"host\") returned %+v, %v", r, err)
+	}
+	if _, err = c.GetAll("missing", "host"); err == nil {
+		t.Error("c.GetAll(\"missing\",\"host\") returned no error")
+	}
+}
+
+func TestSectionArrays(t *testing.T) {
+	const servers = "[[server]]\nhost = a\n[single]\nx = 1\n[[server]]\nhost = b\n"
+
+	c, err := ReadConfigBytes([]byte(servers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := c.GetSectionList("server")
+	if strings.Join(list, ",") != "server.0,server.1" {
+		t.Fatalf("c.GetSectionList(\"server\") returned %q", list)
+	}
+	if v, _ := c.GetString(list[1], "host"); v != "b" {
+		t.Errorf("second server host is %q, want b", v)
+	}
+	if len(c.GetSectionList("single")) != 0 {
+		t.Error("a [single] section was read as a section array")
+	}
+
+	r, err := ReadConfigBytes(c.WriteConfigBytes(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(r.GetSectionList("server"), ",") != "server.0,server.1" {
+		t.Errorf("section array was not written back, got:\n%s", c.WriteConfigBytes(""))
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.GetRawString("service-1", "url"); v != "http://example.com/something" {
+		t.Errorf("resolved url is %q", v)
+	}
+	if v, _ := c.GetRawString("service-1", "url"); v != "http://%(host)s/something" {
+		t.Errorf("c.Resolve() changed the original url to %q", v)
+	}
+
+	c.AddOption("service-1", "broken", "%(missing)s")
+	if _, err = c.Resolve(); err == nil || !strings.Contains(err.Error(), "'broken'") {
+		t.Errorf("c.Resolve() returned error %v, want one naming option broken", err)
+	}
+	var ge GetError
+	if !errors.As(err, &ge) || ge.Reason != OptionNotFound || ge.Option != "missing" {
+		t.Errorf("c.Resolve() returned error %v, want it to wrap the GetError for missing", err)
+	}
+}
+
+func TestGetRawStringDefault(t *testing.T) {
+	c, err := ReadConfigBytes([]byte(confFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.GetRawStringDefault("service-1", "url", "fallback"); v != "http://%(host)s/something" {
+		t.Errorf("c.GetRawStringDefault(\"service-1\",\"url\") returned %q", v)
+	}
+	if v := c.GetRawStringDefault("service-1", "missing", "fallback"); v != "fallback" {
+		t.Errorf("c.GetRawStringDefault(\"service-1\",\"missing\") returned %q", v)
+	}
+	if v := c.GetRawStringDefault("missing", "url", "fallback"); v != "fallback" {
+		t.Errorf("c.GetRawStringDefault(\"missing\",\"url\") returned %q", v)
+	}
+}
+
+func TestDelimiters(t *testing.T) {
+	const mixed = "host: example.com\nurl = http://example.com:8080/\nproxy: http://proxy:3128\n"
+
+	c, err := ReadConfigBytes([]byte(mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for option, answer := range map[string]string{
+		"host":  "example.com",
+		"url":   "http://example.com:8080/",
+		"proxy": "http://proxy:3128",
+	} {
+		if v, _ := c.GetRawString("", option); v != answer {
+			t.Errorf("c.GetRawString(\"\",%q) returned %q, want %q", option, v, answer)
+		}
+	}
+
+	c = NewConfigFile()
+	c.Delimiters = []byte{'='}
+	if err = c.Read(strings.NewReader("a:b = c\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetRawString("", "a:b"); v != "c" {
+		t.Errorf("option a:b is %q with '=' as the only delimiter", v)
+	}
+}
+
+func TestSetComments(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("service", "port", "443")
+
+	if err := c.SetSectionComment("service", "The service.\nSee the manual."); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOptionComment("service", "port", "TLS port"); err != nil {
+		t.Fatal(err)
+	}
+	want := "# The service.\n# See the manual.\n[service]\n# TLS port\nport=443\n\n"
+	if out := string(c.WriteConfigBytes("")); out != want {
+		t.Errorf("comments were written as:\n%s", out)
+	}
+
+	c.SetOptionComment("service", "port", "")
+	want = "# The service.\n# See the manual.\n[service]\nport=443\n\n"
+	if out := string(c.WriteConfigBytes("")); out != want {
+		t.Errorf("cleared comment was written as:\n%s", out)
+	}
+	if err := c.SetOptionComment("service", "missing", "x"); err == nil {
+		t.Error("c.SetOptionComment() of a missing option returned no error")
+	}
+}
+
+func TestStrictDuplicates(t *testing.T) {
+	for _, e := range []struct {
+		conf   string
+		reason Reason
+		lineNo int
+	}{
+		{"[s]\nport = 1\nhost = a\nport = 2\n", DuplicateOption, 4},
+		{"[s]\nport = 1\n[t]\n[s]\nhost = a\n", DuplicateSection, 4},
+	} {
+		c := NewConfigFile()
+		if err := c.Read(strings.NewReader(e.conf)); err != nil {
+			t.Errorf("lenient c.Read() returned error %v", err)
+		}
+
+		c = NewConfigFile()
+		c.StrictDuplicates = true
+		err := c.Read(strings.NewReader(e.conf))
+		errs, ok := err.(MultiError)
+		if !ok || len(errs.Errors()) != 1 {
+			t.Errorf("strict c.Read() returned error %v, want one duplicate", err)
+			continue
+		}
+		if re, ok := errs[0].(ReadError); !ok || re.Reason != e.reason || re.LineNo != e.lineNo || re.Section != "s" {
+			t.Errorf("strict c.Read() returned error %v, want reason %q on line %d", err, e.reason, e.lineNo)
+		}
+	}
+}
+
+func TestGetStringExpand(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "user", "admin")
+	c.AddOption("default", "dsn", "%(user)s:%(db_password)s@%(db_host)s")
+
+	secrets := map[string]string{"db_password": "s3cr%t", "user": "ignored"}
+	resolve := func(name string) (string, bool) {
+		v, ok := secrets[name]
+		return v, ok
+	}
+
+	_, err := c.GetStringExpand("", "dsn", resolve)
+	if e, ok := err.(GetError); !ok || e.Reason != OptionNotFound || e.Option != "db_host" {
+		t.Errorf("c.GetStringExpand() returned error %v, want db_host not found", err)
+	}
+	secrets["db_host"] = "localhost"
+	if v, err := c.GetStringExpand("", "dsn", resolve); err != nil || v != "admin:s3cr%t@localhost" {
+		t.Errorf("c.GetStringExpand() returned %q, %v", v, err)
+	}
+}
+
+func TestReferenceDefaults(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "port", "8080")
+	c.AddOption("default", "url", "%(scheme:http)s://%(host:localhost)s:%(port:80)s%(path:)s")
+	c.AddOption("default", "proxy", "%(proxy_url:http://proxy:3128)s")
+	c.AddOption("default", "broken", "%(missing)s")
+
+	if v, err := c.GetString("", "url"); err != nil || v != "http://localhost:8080" {
+		t.Errorf("c.GetString(\"\",\"url\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetString("", "proxy"); err != nil || v != "http://proxy:3128" {
+		t.Errorf("c.GetString(\"\",\"proxy\") returned %q, %v", v, err)
+	}
+	if _, err := c.GetString("", "broken"); err == nil {
+		t.Error("c.GetString(\"\",\"broken\") returned no error")
+	}
+}
+
+func TestWalkOptions(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("b", "port", "80")
+	c.AddOption("b", "url", "http://%(host)s")
+	c.AddOption("a", "name", "x")
+
+	var visited []string
+	c.WalkOptions(func(section, option, rawValue string) bool {
+		visited = append(visited, section+"."+option+"="+rawValue)
+		return true
+	})
+	want := "default.host=example.com b.port=80 b.url=http://%(host)s a.name=x"
+	if got := strings.Join(visited, " "); got != want {
+		t.Errorf("WalkOptions visited %q, want %q", got, want)
+	}
+
+	n := 0
+	c.WalkOptions(func(section, option, rawValue string) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("WalkOptions did not stop early: fn called %d times", n)
+	}
+}
+
+func TestGetIntInRange(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "workers", "16")
+	c.AddOption("default", "retries", "0")
+
+	if v, err := c.GetIntInRange("default", "workers", 1, 16); err != nil || v != 16 {
+		t.Errorf("GetIntInRange(workers, 1, 16) returned %d, %v", v, err)
+	}
+	_, err := c.GetIntInRange("default", "retries", 1, 5)
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "int[1,5]" {
+		t.Errorf("GetIntInRange(retries, 1, 5) returned %#v", err)
+	}
+	if _, err := c.GetIntInRange("default", "missing", 1, 5); !isMissing(err) {
+		t.Errorf("GetIntInRange(missing) returned %v", err)
+	}
+}
+
+func TestReasonString(t *testing.T) {
+	if s := OptionNotFound.String(); s != "option not found" {
+		t.Errorf("OptionNotFound.String() = %q", s)
+	}
+	if s := Reason(99).String(); s != "Reason(99)" {
+		t.Errorf("Reason(99).String() = %q", s)
+	}
+
+	err := GetError{CouldNotParse, "int", "abc", "server", "port"}
+	if s := err.Error(); s != "could not parse int value 'abc' of option 'port' in section 'server'" {
+		t.Errorf("GetError.Error() = %q", s)
+	}
+}
+
+func TestImportEnviron(t *testing.T) {
+	os.Setenv("GOCONF_IMPORT_DB_HOST", "db.example.com")
+	os.Setenv("GOCONF_IMPORT_PORT", "5432")
+	defer os.Unsetenv("GOCONF_IMPORT_DB_HOST")
+	defer os.Unsetenv("GOCONF_IMPORT_PORT")
+
+	c := NewConfigFile()
+	c.ImportEnviron("env", "GOCONF_IMPORT_")
+	if v, err := c.GetString("env", "db_host"); err != nil || v != "db.example.com" {
+		t.Errorf("c.GetString(\"env\",\"db_host\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetInt("env", "port"); err != nil || v != 5432 {
+		t.Errorf("c.GetInt(\"env\",\"port\") returned %d, %v", v, err)
+	}
+	if options, _ := c.GetOptionsLocal("env"); len(options) != 2 {
+		t.Errorf("ImportEnviron imported %v, want only the prefixed variables", options)
+	}
+
+	c = NewConfigFile()
+	c.EnvironSeparator = "."
+	c.ImportEnviron("default", "GOCONF_IMPORT_")
+	if v, err := c.GetString("default", "db.host"); err != nil || v != "db.example.com" {
+		t.Errorf("c.GetString(\"default\",\"db.host\") returned %q, %v", v, err)
+	}
+
+	c = NewConfigFile()
+	c.ImportEnviron("env", "")
+	if !c.HasOption("env", "goconf_import_port") {
+		t.Error("ImportEnviron with an empty prefix did not import every variable")
+	}
+}
+
+func TestGetStringNonEmpty(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "user", "")
+	c.AddOption("s", "host", "")
+	c.AddOption("s", "port", "8080")
+
+	for _, e := range []struct {
+		section, option, want string
+	}{
+		{"s", "port", "8080"},
+		{"s", "host", "example.com"}, // empty: default section
+		{"s", "user", "nobody"},      // empty in the default section too: fallback
+		{"s", "missing", "nobody"},
+		{"missing", "host", "example.com"},
+	} {
+		if v := c.GetStringNonEmpty(e.section, e.option, "nobody"); v != e.want {
+			t.Errorf("GetStringNonEmpty(%q, %q) = %q, want %q", e.section, e.option, v, e.want)
+		}
+	}
+}
+
+func TestDirty(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("[a]\nx = 1\ny = 2\n[b]\nz = 3\n"))
+	if err != nil {
+		t.Fatalf("ReadConfigBytes returned error: %v", err)
+	}
+	if d := c.Dirty(); len(d) != 0 {
+		t.Errorf("Dirty() after reading = %v, want none", d)
+	}
+
+	c.AddOption("b", "Z", "4")
+	c.RemoveOption("a", "x")
+	c.SetInt("a", "new", 5)
+	want := []OptionRef{{"a", "new"}, {"a", "x"}, {"b", "z"}}
+	if d := c.Dirty(); !reflect.DeepEqual(d, want) {
+		t.Errorf("Dirty() = %v, want %v", d, want)
+	}
+
+	if d := c.Copy().Dirty(); !reflect.DeepEqual(d, want) {
+		t.Errorf("c.Copy().Dirty() = %v, want %v", d, want)
+	}
+
+	c.ClearDirty()
+	if d := c.Dirty(); len(d) != 0 {
+		t.Errorf("Dirty() after ClearDirty = %v, want none", d)
+	}
+}
+
+func TestGetRune(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "sep", ";")
+	c.AddOption("default", "quote", "«")
+	c.AddOption("default", "empty", "")
+	c.AddOption("default", "two", "ab")
+	c.AddOption("default", "replacement", "\uFFFD")
+	c.AddOption("default", "invalid", "\xff")
+
+	if r, err := c.GetRune("", "sep"); err != nil || r != ';' {
+		t.Errorf("GetRune(sep) returned %q, %v", r, err)
+	}
+	if r, err := c.GetRune("", "quote"); err != nil || r != '«' {
+		t.Errorf("GetRune(quote) returned %q, %v", r, err)
+	}
+	if r, err := c.GetRune("", "replacement"); err != nil || r != '\uFFFD' {
+		t.Errorf("GetRune(replacement) returned %q, %v", r, err)
+	}
+	for _, option := range []string{"empty", "two", "invalid"} {
+		if _, err := c.GetRune("", option); err == nil {
+			t.Errorf("GetRune(%s) returned no error", option)
+		}
+	}
+}
+
+func TestMustGet(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "port", "443")
+	c.AddOption("default", "tls", "on")
+	c.AddOption("default", "ratio", "0.5")
+
+	if c.MustGetString("", "port") != "443" || c.MustGetInt("", "port") != 443 ||
+		!c.MustGetBool("", "tls") || c.MustGetFloat64("", "ratio") != 0.5 {
+		t.Error("MustGet functions returned wrong values")
+	}
+
+	defer func() {
+		if e, ok := recover().(GetError); !ok || e.Reason != OptionNotFound {
+			t.Errorf("MustGetInt(missing) panicked with %#v, want an OptionNotFound GetError", e)
+		}
+	}()
+	c.MustGetInt("", "missing")
+}
+
+func TestGetOrCreateSection(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "user", "admin")
+
+	kv, err := c.GetOrCreateSection("db")
+	if err != nil || !reflect.DeepEqual(kv, map[string]string{"host": "localhost", "port": "5432", "user": "admin"}) {
+		t.Errorf("GetOrCreateSection(db) = %v, %v", kv, err)
+	}
+	kv["port"] = "6432"
+	delete(kv, "user")
+	kv["name"] = "app"
+	kv["pool"] = "10"
+	if v, _ := c.GetRawString("db", "port"); v != "5432" {
+		t.Errorf("changing the snapshot changed the configuration: port = %q", v)
+	}
+
+	c.SetSection("db", kv)
+	if options, _ := c.GetOptionsLocal("db"); strings.Join(options, " ") != "host port name pool" {
+		t.Errorf("after SetSection, options = %v", options)
+	}
+	if v, _ := c.GetRawString("db", "port"); v != "6432" {
+		t.Errorf("after SetSection, port = %q", v)
+	}
+
+	if kv, _ := c.GetOrCreateSection("cache"); len(kv) != 0 || !c.HasSection("cache") {
+		t.Errorf("GetOrCreateSection(cache) = %v, created: %v", kv, c.HasSection("cache"))
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "app.conf")
+	local := filepath.Join(dir, "local.conf")
+	bad := filepath.Join(dir, "bad.conf")
+	ioutil.WriteFile(base, []byte("[db]\nhost = db.example.com\nport = 5432\n"), 0644)
+	ioutil.WriteFile(local, []byte("[db]\nhost = localhost\n"), 0644)
+	ioutil.WriteFile(bad, []byte("[db]\nmalformed\n"), 0644)
+
+	c := NewConfigFile()
+	if err = c.ReadFiles(base, local); err != nil {
+		t.Fatalf("ReadFiles returned error: %v", err)
+	}
+	if v, _ := c.GetString("db", "host"); v != "localhost" {
+		t.Errorf("db.host = %q, want the value of the later file", v)
+	}
+	if v, _ := c.GetString("db", "port"); v != "5432" {
+		t.Errorf("db.port = %q, want the value of the earlier file", v)
+	}
+
+	err = NewConfigFile().ReadFiles(base, bad)
+	if e, ok := err.(ReadError); !ok || e.File != bad || !strings.HasPrefix(e.Error(), bad+", line 2:") {
+		t.Errorf("ReadFiles with a malformed file returned %v", err)
+	}
+	missing := filepath.Join(dir, "missing.conf")
+	if err = NewConfigFile().ReadFiles(missing); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("ReadFiles with a missing file returned %v", err)
+	}
+}
+
+func TestReadGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "20-local.conf"), []byte("[db]\nhost = localhost\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "10-base.conf"), []byte("[db]\nhost = db.example.com\nport = 5432\n"), 0644)
+
+	c := NewConfigFile()
+	if err = c.ReadGlob(filepath.Join(dir, "*.conf")); err != nil {
+		t.Fatalf("ReadGlob returned error: %v", err)
+	}
+	if v, _ := c.GetString("db", "host"); v != "localhost" {
+		t.Errorf("db.host = %q, want the value of 20-local.conf", v)
+	}
+
+	if err = c.ReadGlob(filepath.Join(dir, "*.missing")); err != nil {
+		t.Errorf("ReadGlob with no match returned error: %v", err)
+	}
+
+	bad := filepath.Join(dir, "30-bad.conf")
+	ioutil.WriteFile(bad, []byte("[db]\nmalformed\n"), 0644)
+	if e, ok := c.ReadGlob(filepath.Join(dir, "*.conf")).(ReadError); !ok || e.File != bad {
+		t.Errorf("ReadGlob with a malformed file returned %v", e)
+	}
+}
+
+func TestGetSectionsWithPrefix(t *testing.T) {
+	c := NewConfigFile()
+	c.AddSection("cache.redis")
+	c.AddSection("db")
+	c.AddSection("Cache.Memcached")
+
+	if s := c.GetSectionsWithPrefix("CACHE."); strings.Join(s, " ") != "cache.redis cache.memcached" {
+		t.Errorf("GetSectionsWithPrefix(CACHE.) = %v", s)
+	}
+	if s := c.GetSectionsWithPrefix("queue."); s == nil || len(s) != 0 {
+		t.Errorf("GetSectionsWithPrefix(queue.) = %#v, want an empty list", s)
+	}
+}
+
+func TestClear(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("# header\n[a]\nx = 1\n[[arr]]\ny = 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ListSeparator = ";"
+	c.AddOption("default", "z", "3")
+
+	c.Clear()
+	if s := c.GetSections(); len(s) != 1 || s[0] != DefaultSection {
+		t.Errorf("after Clear, sections = %v", s)
+	}
+	if c.HasOption("default", "z") || len(c.Dirty()) != 0 || len(c.GetSectionList("arr")) != 0 {
+		t.Error("Clear left options, changes or section arrays behind")
+	}
+	if c.ListSeparator != ";" {
+		t.Errorf("Clear reset ListSeparator to %q", c.ListSeparator)
+	}
+	var buf bytes.Buffer
+	if c.WriteTo(&buf); strings.Contains(buf.String(), "header") {
+		t.Errorf("after Clear, Write wrote %q", buf.String())
+	}
+}
+
+func TestGetPrefixedOptions(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "domain", "example.com")
+	c.AddOption("default", "server.1.port", "80")
+	c.AddOption("s", "server.1.host", "www.%(domain)s")
+	c.AddOption("s", "server.1.port", "8080")
+	c.AddOption("s", "server.2.host", "db")
+
+	options, err := c.GetPrefixedOptions("s", "Server.1.")
+	want := map[string]string{"host": "www.example.com", "port": "8080"}
+	if err != nil || !reflect.DeepEqual(options, want) {
+		t.Errorf("GetPrefixedOptions(s, server.1.) returned %v, %v; want %v", options, err, want)
+	}
+	if _, err = c.GetPrefixedOptions("missing", "server."); err == nil {
+		t.Error("GetPrefixedOptions on a missing section returned no error")
+	}
+}
+
+func TestGetStringDepth(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "a", "%(b)s")
+	c.AddOption("default", "b", "%(c)s")
+	c.AddOption("default", "c", "x")
+
+	if v, err := c.GetStringDepth("", "a", 3); err != nil || v != "x" {
+		t.Errorf("GetStringDepth(a, 3) returned %q, %v", v, err)
+	}
+	if _, err := c.GetStringDepth("", "a", 2); err == nil {
+		t.Error("GetStringDepth(a, 2) returned no error")
+	} else if e, ok := err.(GetError); !ok || e.Reason != MaxDepthReached {
+		t.Errorf("GetStringDepth(a, 2) returned %v, want MaxDepthReached", err)
+	}
+	if v, err := c.GetStringDepth("", "b", 2); err != nil || v != "x" {
+		t.Errorf("GetStringDepth(b, 2) returned %q, %v", v, err)
+	}
+	if _, err := c.GetStringDepth("", "c", 0); err == nil {
+		t.Error("GetStringDepth(c, 0) returned no error")
+	}
+}
+
+func TestQuoteValues(t *testing.T) {
+	values := map[string]string{
+		"spaced":  "  spaced  ",
+		"comment": "# not a comment",
+		"inline":  "value ; with a semicolon",
+		"delim":   "a=b",
+		"quoted":  `"quoted"`,
+		"lines":   "first\nsecond",
+		"slash":   `C:\dir\`,
+		"plain":   "plain value",
+	}
+	c := NewConfigFile()
+	c.QuoteValues = true
+	for option, value := range values {
+		c.AddOption("s", option, value)
+	}
+
+	var buf bytes.Buffer
+	c.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "plain=plain value\n") || !strings.Contains(buf.String(), `spaced="  spaced  "`) {
+		t.Errorf("WriteTo wrote:\n%s", buf.String())
+	}
+
+	r := NewConfigFile()
+	r.QuoteValues = true
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("Read returned error: %v", err)
+	}
+	for option, value := range values {
+		if v, err := r.GetRawString("s", option); err != nil || v != value {
+			t.Errorf("read back %s = %q, %v; want %q", option, v, err, value)
+		}
+	}
+
+	r = NewConfigFile()
+	r.Read(strings.NewReader("[s]\nkey = \"  a  \" # comment\n"))
+	if v, _ := r.GetRawString("s", "key"); v != `"  a  "` {
+		t.Errorf("without QuoteValues, key = %q", v)
+	}
+}
+
+func TestGetTime(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "start", "2016-01-02T15:04:05+01:00")
+	c.AddOption("default", "day", "2016-01-02")
+	c.AddOption("default", "bad", "tomorrow")
+
+	v, err := c.GetTime("", "start")
+	if _, offset := v.Zone(); err != nil || offset != 3600 || v.Hour() != 15 {
+		t.Errorf("GetTime(start) returned %v, %v", v, err)
+	}
+	v, err = c.GetTimeFormat("", "day", "2006-01-02")
+	if err != nil || !v.Equal(time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("GetTimeFormat(day) returned %v, %v", v, err)
+	}
+	if _, err = c.GetTime("", "bad"); err == nil {
+		t.Error("GetTime(bad) returned no error")
+	} else if e, ok := err.(GetError); !ok || e.ValueType != "time" {
+		t.Errorf("GetTime(bad) returned %v", err)
+	}
+}
+
+func TestStrictDuplicatesAll(t *testing.T) {
+	c := NewConfigFile()
+	c.StrictDuplicates = true
+	err := c.Read(strings.NewReader("[s]\na = 1\na = 2\n[t]\n[s]\nb = 1\nb = 2\n"))
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("strict c.Read() returned %v, want three duplicates", err)
+	}
+	if s := err.Error(); s != "line 3: duplicate option 'a' in section 's'\n"+
+		"line 5: duplicate section 's'\n"+
+		"line 7: duplicate option 'b' in section 's'" {
+		t.Errorf("MultiError.Error() = %q", s)
+	}
+}
+
+func TestGetStringListWith(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "list", "a, ,b,")
+	c.AddOption("default", "blank", " ")
+
+	for _, e := range []struct {
+		opts ListOptions
+		want []string
+	}{
+		{ListOptions{}, []string{"a", "b"}},
+		{ListOptions{KeepEmpty: true}, []string{"a", "", "b", ""}},
+		{ListOptions{NoTrim: true}, []string{"a", " ", "b"}},
+		{ListOptions{NoTrim: true, KeepEmpty: true}, []string{"a", " ", "b", ""}},
+	} {
+		list, err := c.GetStringListWith("", "list", e.opts)
+		if err != nil || !reflect.DeepEqual(list, e.want) {
+			t.Errorf("GetStringListWith(list, %+v) returned %q, %v; want %q", e.opts, list, err, e.want)
+		}
+	}
+	if list, _ := c.GetStringListWith("", "blank", ListOptions{KeepEmpty: true}); len(list) != 0 {
+		t.Errorf("GetStringListWith(blank) = %q, want an empty list", list)
+	}
+}
+
+func TestSortOnWrite(t *testing.T) {
+	c := NewConfigFile()
+	c.SortOnWrite = true
+	c.AddOption("default", "z", "1")
+	c.AddOption("default", "a", "2")
+	c.AddOption("zeta", "b", "3")
+	c.AddOption("alpha", "y", "4")
+	c.AddOption("alpha", "x", "5")
+	for i := 0; i < 11; i++ {
+		c.AddOption("item."+strconv.Itoa(i), "n", strconv.Itoa(i))
+	}
+	c.Read(strings.NewReader("[[srv]]\nn = 1\n[[srv]]\nn = 2\n"))
+
+	var buf bytes.Buffer
+	c.WriteTo(&buf)
+	want := "a=2\nz=1\n\n[alpha]\nx=5\ny=4\n\n"
+	if !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("sorted WriteTo wrote:\n%s\nwant it to start with:\n%s", buf.String(), want)
+	}
+	if !strings.HasSuffix(buf.String(), "[[srv]]\nn=1\n\n[[srv]]\nn=2\n\n[zeta]\nb=3\n\n") {
+		t.Errorf("sorted WriteTo wrote:\n%s", buf.String())
+	}
+	if s := c.GetSections(); s[1] != "zeta" {
+		t.Errorf("SortOnWrite changed the section order: %v", s)
+	}
+}
+
+func TestReadErrorLines(t *testing.T) {
+	for _, e := range []struct {
+		conf   string
+		quote  bool
+		reason Reason
+		lineNo int
+		msg    string
+	}{
+		{"[s]\na = 1\n\n[t\nb = 2\n", false, MalformedSection, 4, "line 4: malformed section header: [t"},
+		{"[s]\na = \"open\n", true, UnterminatedQuote, 2, "line 2: unterminated quote in value of option 'a': a = \"open"},
+		{"[s]\n\nnodelimiter\n", false, CouldNotParse, 3, "line 3: could not parse line, no delimiter found: nodelimiter"},
+	} {
+		c := NewConfigFile()
+		c.QuoteValues = e.quote
+		err := c.Read(strings.NewReader(e.conf))
+		if re, ok := err.(ReadError); !ok || re.Reason != e.reason || re.LineNo != e.lineNo || re.Error() != e.msg {
+			t.Errorf("c.Read(%q) returned %v, want %q", e.conf, err, e.msg)
+		}
+	}
+
+	c := NewConfigFile()
+	if err := c.Read(strings.NewReader("[s]\na = \"open\n")); err != nil {
+		t.Errorf("without QuoteValues, c.Read() returned %v", err)
+	}
+}
+
+func TestQualifiedReferences(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "port", "5432")
+	c.AddOption("database", "host", "db.example.com")
+	c.AddOption("database", "url", "%(host)s:%(port)s")
+	c.AddOption("app", "host", "app.example.com")
+	c.AddOption("app", "dsn", "postgres://%([database]url)s/%([Database]name:app)s")
+	c.AddOption("app", "backup", "%([database]port)s")
+	c.AddOption("app", "a", "%([other]b)s")
+	c.AddOption("other", "b", "%([app]a)s")
+	c.AddOption("other", "a", "ok")
+	c.AddOption("app", "c", "%([other]d)s")
+	c.AddOption("other", "d", "%(a)s") // the option a of other, not of app
+
+	if v, err := c.GetString("app", "dsn"); err != nil || v != "postgres://db.example.com:5432/app" {
+		t.Errorf("c.GetString(\"app\",\"dsn\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetString("app", "backup"); err != nil || v != "5432" {
+		t.Errorf("c.GetString(\"app\",\"backup\") returned %q, %v", v, err)
+	}
+	if v, err := c.GetString("app", "c"); err != nil || v != "ok" {
+		t.Errorf("c.GetString(\"app\",\"c\") returned %q, %v", v, err)
+	}
+	_, err := c.GetString("app", "a")
+	if e, ok := err.(GetError); !ok || e.Reason != MaxDepthReached || e.Value != "a -> [other]b -> a" {
+		t.Errorf("c.GetString(\"app\",\"a\") returned %v, want a cycle", err)
+	}
+}
+
+func TestTypedDefaults(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "workers", "8")
+	c.AddOption("default", "garbage", "lots")
+
+	if v, err := c.GetIntDefault("", "workers", 4); err != nil || v != 8 {
+		t.Errorf("GetIntDefault(workers) returned %d, %v", v, err)
+	}
+	if v, err := c.GetIntDefault("", "missing", 4); err != nil || v != 4 {
+		t.Errorf("GetIntDefault(missing) returned %d, %v", v, err)
+	}
+	if v, err := c.GetBoolDefault("nosection", "tls", true); err != nil || !v {
+		t.Errorf("GetBoolDefault(missing section) returned %v, %v", v, err)
+	}
+	if v, err := c.GetFloat64Default("", "missing", 0.5); err != nil || v != 0.5 {
+		t.Errorf("GetFloat64Default(missing) returned %v, %v", v, err)
+	}
+	if v, err := c.GetDurationDefault("", "missing", time.Second); err != nil || v != time.Second {
+		t.Errorf("GetDurationDefault(missing) returned %v, %v", v, err)
+	}
+
+	if _, err := c.GetIntDefault("", "garbage", 4); err == nil {
+		t.Error("GetIntDefault(garbage) returned no error")
+	}
+	if _, err := c.GetBoolDefault("", "garbage", true); err == nil {
+		t.Error("GetBoolDefault(garbage) returned no error")
+	}
+	if _, err := c.GetFloat64Default("", "garbage", 0.5); err == nil {
+		t.Error("GetFloat64Default(garbage) returned no error")
+	}
+	if _, err := c.GetDurationDefault("", "garbage", time.Second); err == nil {
+		t.Error("GetDurationDefault(garbage) returned no error")
+	}
+}
+
+func TestSectionView(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "scheme", "pg")
+	c.AddOption("common", "timeout", "30s")
+	c.AddOption("db", ExtendsOption, "common")
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "url", "%(scheme)s://%(host)s/")
+
+	db := c.Section("db")
+	if v, err := db.GetString("host"); err != nil || v != "localhost" {
+		t.Errorf("db.GetString(host) returned %q, %v", v, err)
+	}
+	if v, err := db.GetInt("port"); err != nil || v != 5432 {
+		t.Errorf("db.GetInt(port) returned %d, %v", v, err)
+	}
+	if v, err := db.GetDuration("timeout"); err != nil || v != 30*time.Second {
+		t.Errorf("db.GetDuration(timeout) inherited %v, %v", v, err)
+	}
+	if v, err := db.GetString("url"); err != nil || v != "pg://localhost/" {
+		t.Errorf("db.GetString(url) returned %q, %v", v, err)
+	}
+	_, err := db.GetString("scheme")
+	if _, want := c.GetString("db", "scheme"); err == nil || err != want {
+		t.Errorf("db.GetString(scheme) returned %v, want %v as GetString", err, want)
+	}
+	if !db.HasOption("scheme") {
+		t.Error("db.HasOption(scheme) = false")
+	}
+
+	c.AddOption("db", "port", "6432")
+	if v, _ := db.GetInt("port"); v != 6432 {
+		t.Errorf("db.GetInt(port) = %d after a change, want 6432", v)
+	}
+	if _, err := c.Section("missing").GetString("timeout"); err == nil {
+		t.Error("GetString on a view of a missing section returned no error")
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	main := filepath.Join(dir, "main.conf")
+	ioutil.WriteFile(main, []byte("[app]\nname = main\n@include conf.d/db.conf\nport = 80\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "db.conf"), []byte("timeout = 5\n[db]\nhost = localhost\n# end of db\n"), 0644)
+
+	c := NewConfigFile()
+	if err = c.ReadFiles(main); err != nil {
+		t.Fatal(err)
+	}
+	if c.HasSection("db") {
+		t.Error("the include directive was followed without IncludeDirective")
+	}
+
+	c = NewConfigFile()
+	c.IncludeDirective = "@include"
+	if err = c.ReadFiles(main); err != nil {
+		t.Fatalf("ReadFiles with includes returned error: %v", err)
+	}
+	for _, e := range []struct{ section, option, value string }{
+		{"app", "name", "main"},
+		{"app", "port", "80"}, // back to the including section
+		{"db", "host", "localhost"},
+		{"default", "timeout", "5"},
+	} {
+		if v, err := c.GetRawString(e.section, e.option); err != nil || v != e.value {
+			t.Errorf("%s.%s = %q, %v; want %q", e.section, e.option, v, err, e.value)
+		}
+	}
+	if out := string(c.WriteConfigBytes("")); !strings.Contains(out, "# end of db\nport=80\n") {
+		t.Errorf("the trailing comment of the included file was moved, wrote:\n%s", out)
+	}
+
+	a := filepath.Join(dir, "a.conf")
+	b := filepath.Join(dir, "b.conf")
+	ioutil.WriteFile(a, []byte("@include = b.conf\n"), 0644)
+	ioutil.WriteFile(b, []byte("[b]\n@include a.conf\n"), 0644)
+	c = NewConfigFile()
+	c.IncludeDirective = "@include"
+	err = c.ReadFiles(a)
+	if e, ok := err.(IncludeCycleError); !ok || strings.Join(e.Files, " ") != a+" "+b+" "+a {
+		t.Errorf("ReadFiles with an include cycle returned %v", err)
+	}
+
+	ioutil.WriteFile(b, []byte("[b]\nmalformed\n"), 0644)
+	if e, ok := c.ReadFiles(a).(ReadError); !ok || e.File != b || e.LineNo != 2 {
+		t.Errorf("ReadFiles with a malformed included file returned %v", e)
+	}
+}
+
+func TestGetStringSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.conf")
+	local := filepath.Join(dir, "local.conf")
+	ioutil.WriteFile(base, []byte("[db]\nhost = db.example.com\nport = 5432\n"), 0644)
+	ioutil.WriteFile(local, []byte("[db]\nhost = localhost\n"), 0644)
+
+	c := NewConfigFile()
+	if err = c.ReadFiles(base, local); err != nil {
+		t.Fatal(err)
+	}
+	c.Read(strings.NewReader("[db]\nuser = app\n"))
+	c.AddOption("db", "password", "secret")
+
+	for _, e := range []struct{ option, source string }{
+		{"host", local},
+		{"port", base},
+		{"user", SourceReader},
+		{"password", SourceSet},
+	} {
+		if _, source, err := c.GetStringSource("db", e.option); err != nil || source != e.source {
+			t.Errorf("GetStringSource(db, %s) returned source %q, %v; want %q", e.option, source, err, e.source)
+		}
+	}
+
+	m := NewConfigFile()
+	m.Merge(c)
+	if _, source, _ := m.GetStringSource("db", "port"); source != base {
+		t.Errorf("after Merge, GetStringSource(db, port) returned source %q, want %q", source, base)
+	}
+}
+
+func TestWriteShellExport(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "env", "prod")
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "domain", "example.com")
+	c.AddOption("db", "host", "db.%(domain)s")
+	c.AddOption("db", "password", "p\"$`\\w")
+	c.AddOption("db", "2fa.key", "x")
+
+	var buf bytes.Buffer
+	if err := c.WriteShellExport(&buf, "db"); err != nil {
+		t.Fatalf("WriteShellExport returned error: %v", err)
+	}
+	want := "ENV=\"prod\"\n" +
+		"DOMAIN=\"example.com\"\n" +
+		"HOST=\"db.example.com\"\n" +
+		"PASSWORD=\"p\\\"\\$\\`\\\\w\"\n" +
+		"_2FA_KEY=\"x\"\n"
+	if buf.String() != want {
+		t.Errorf("WriteShellExport wrote:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if err := c.WriteShellExport(&buf, "missing"); err == nil {
+		t.Error("WriteShellExport of a missing section returned no error")
+	}
+}
+
+func TestCheckAgainstSchema(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("debug = on\n[db]\nhsot = x\nport = 5432\n[plugins]\nanything = 1\n[typo]\na = 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := c.CheckAgainstSchema(map[string][]string{
+		"default": {"debug"},
+		"DB":      {"host", "Port"},
+		"plugins": {AnyOption},
+	})
+	want := []OptionRef{{"db", "hsot"}, {"typo", "a"}}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("CheckAgainstSchema returned %v, want %v", unknown, want)
+	}
+}
+
+func TestGetEnum(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "level", "Info")
+	levels := []string{"debug", "info", "warn"}
+
+	if v, err := c.GetEnum("", "level", levels); err != nil || v != "info" {
+		t.Errorf("GetEnum(level) returned %q, %v", v, err)
+	}
+	c.CaseSensitive = true
+	_, err := c.GetEnum("default", "level", levels)
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "enum[debug,info,warn]" {
+		t.Errorf("case-sensitive GetEnum(level) returned %v", err)
+	}
+}
+
+func TestSetFromMap(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "user", "admin")
+
+	err := c.SetFromMap(map[string]map[string]string{
+		"db":    {"host": "db.example.com", "port": "5432"},
+		"cache": {"ttl": "60"},
+	})
+	if err != nil {
+		t.Fatalf("SetFromMap returned error: %v", err)
+	}
+	for _, e := range []struct{ section, option, value string }{
+		{"db", "host", "db.example.com"},
+		{"db", "port", "5432"},
+		{"db", "user", "admin"}, // untouched
+		{"cache", "ttl", "60"},
+	} {
+		if v, _ := c.GetRawString(e.section, e.option); v != e.value {
+			t.Errorf("%s.%s = %q, want %q", e.section, e.option, v, e.value)
+		}
+	}
+
+	err = c.SetFromMap(map[string]map[string]string{
+		"db":    {"host": "other"},
+		"cache": {"bad=name": "x"},
+	})
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.Option != "bad=name" {
+		t.Errorf("SetFromMap with an invalid name returned %v", err)
+	}
+	if v, _ := c.GetRawString("db", "host"); v != "db.example.com" {
+		t.Errorf("SetFromMap with an invalid name set db.host to %q", v)
+	}
+}
+
+func TestTrimValues(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "name", " value ")
+	c.AddOption("default", "port", "80 ")
+	c.AddOption("default", "url", "http://%(name)s")
+
+	if v, _ := c.GetString("", "name"); v != " value " {
+		t.Errorf("without TrimValues, name = %q", v)
+	}
+	c.TrimValues = true
+	if v, _ := c.GetString("", "name"); v != "value" {
+		t.Errorf("with TrimValues, name = %q", v)
+	}
+	if v, err := c.GetInt("", "port"); err != nil || v != 80 {
+		t.Errorf("with TrimValues, GetInt(port) returned %d, %v", v, err)
+	}
+	if v, _ := c.GetString("", "url"); v != "http:// value" {
+		t.Errorf("with TrimValues, url = %q, want only the result trimmed", v)
+	}
+	if v, _ := c.GetRawString("", "name"); v != " value " {
+		t.Errorf("with TrimValues, GetRawString(name) = %q", v)
+	}
+}
+
+func TestRemoveSection(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("s", "a", "1")
+
+	if removed, err := c.RemoveSection("S"); !removed || err != nil || c.HasSection("s") {
+		t.Errorf("RemoveSection(S) returned %v, %v", removed, err)
+	}
+	if removed, err := c.RemoveSection("s"); removed || err != nil {
+		t.Errorf("RemoveSection of a missing section returned %v, %v", removed, err)
+	}
+	removed, err := c.RemoveSection(DefaultSection)
+	if e, ok := err.(GetError); removed || !ok || e.Reason != ProtectedSection || !c.HasSection(DefaultSection) {
+		t.Errorf("RemoveSection(default) returned %v, %v", removed, err)
+	}
+}
+
+func TestEnableCache(t *testing.T) {
+	c := NewConfigFile()
+	c.EnableCache = true
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("s", "url", "http://%(host)s/")
+
+	if v, _ := c.GetString("s", "url"); v != "http://example.com/" {
+		t.Errorf("url = %q", v)
+	}
+	c.AddOption("default", "host", "example.org")
+	if v, _ := c.GetString("S", "URL"); v != "http://example.org/" {
+		t.Errorf("after a change, cached url = %q", v)
+	}
+	c.RemoveOption("default", "host")
+	if _, err := c.GetString("s", "url"); err == nil {
+		t.Error("after a removal, GetString(url) returned a cached value")
+	}
+}
+
+func benchmarkGetString(b *testing.B, cache bool) {
+	c := NewConfigFile()
+	c.EnableCache = cache
+	c.AddOption("default", "scheme", "https")
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "base", "%(scheme)s://%(host)s")
+	c.AddOption("s", "url", "%(base)s/api/%(version)s")
+	c.AddOption("s", "version", "v1")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetString("s", "url")
+	}
+}
+
+func BenchmarkGetString(b *testing.B)       { benchmarkGetString(b, false) }
+func BenchmarkGetStringCached(b *testing.B) { benchmarkGetString(b, true) }
+
+func TestGetStringListUnique(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "mirrors", "eu, US, eu, us, asia, EU")
+
+	list, err := c.GetStringListWith("", "mirrors", ListOptions{Unique: true})
+	if want := []string{"eu", "US", "asia"}; err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("GetStringListWith(Unique) returned %q, %v; want %q", list, err, want)
+	}
+	c.CaseSensitive = true
+	list, err = c.GetStringListWith("default", "mirrors", ListOptions{Unique: true})
+	if want := []string{"eu", "US", "us", "asia", "EU"}; err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("case-sensitive GetStringListWith(Unique) returned %q, %v; want %q", list, err, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("host = example.com\n[s]\nurl = http://%(host)s/\nrate = 100%%\nempty =\n[[srv]]\nn = 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = c.Encode(&buf); err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+	d := NewConfigFile()
+	d.AddOption("old", "a", "1")
+	if err = d.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if s := d.GetSections(); strings.Join(s, " ") != "default s srv.0" {
+		t.Errorf("decoded sections = %v", s)
+	}
+	for _, e := range []struct{ section, option, value string }{
+		{"s", "url", "http://example.com/"},
+		{"s", "rate", "100%"},
+		{"s", "empty", ""},
+		{"srv.0", "n", "1"},
+	} {
+		if v, err := d.GetString(e.section, e.option); err != nil || v != e.value {
+			t.Errorf("decoded %s.%s = %q, %v; want %q", e.section, e.option, v, err, e.value)
+		}
+	}
+	if l := d.GetSectionList("srv"); len(l) != 1 {
+		t.Errorf("decoded section array srv = %v", l)
+	}
+
+	if err = d.Decode(strings.NewReader("[s]\na = 1\n")); err != ErrSnapshotVersion {
+		t.Errorf("Decode of a configuration file returned %v, want ErrSnapshotVersion", err)
+	}
+	if v, _ := d.GetString("s", "url"); v != "http://example.com/" {
+		t.Error("a failed Decode changed the configuration")
+	}
+}
+
+func TestHasAnyOption(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "debug", "on")
+	c.AddOption("b", "tls", "on")
+	c.AddSection("a")
+
+	if !c.HasAnyOption("TLS", "a", "b") {
+		t.Error("HasAnyOption(TLS, a, b) = false")
+	}
+	if !c.HasAnyOption("debug", "a") {
+		t.Error("HasAnyOption(debug, a) = false, want the default section inherited")
+	}
+	if c.HasAnyOption("tls", "a", "missing") || c.HasAnyOption("debug") {
+		t.Error("HasAnyOption returned true for sections without the option")
+	}
+}
+
+func TestUnsetValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.conf")
+	local := filepath.Join(dir, "local.conf")
+	ioutil.WriteFile(base, []byte("proxy = http://proxy:3128\n[db]\nhost = db.example.com\npassword = secret\n"), 0644)
+	ioutil.WriteFile(local, []byte("proxy = !unset\n[db]\npassword = !unset\n"), 0644)
+
+	c := NewConfigFile()
+	if err = c.ReadFiles(base, local); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetRawString("db", "password"); v != "!unset" {
+		t.Errorf("without UnsetValue, db.password = %q", v)
+	}
+
+	c = NewConfigFile()
+	c.UnsetValue = "!unset"
+	if err = c.ReadFiles(base, local); err != nil {
+		t.Fatal(err)
+	}
+	if c.HasOption("db", "password") || c.HasOption("db", "proxy") {
+		t.Error("options set to UnsetValue by a later file are still defined")
+	}
+	if v, _ := c.GetRawString("db", "host"); v != "db.example.com" {
+		t.Errorf("db.host = %q", v)
+	}
+
+	m := NewConfigFile()
+	m.UnsetValue = "!unset"
+	m.AddOption("db", "password", "secret")
+	m.AddOption("db", "user", "admin")
+	other := NewConfigFile()
+	other.AddOption("db", "password", "!unset")
+	m.Merge(other)
+	if m.HasOption("db", "password") || !m.HasOption("db", "user") {
+		t.Error("Merge did not remove the option set to UnsetValue")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "scheme", "https")
+	c.AddOption("default", "host", "%(name)s.example.com")
+	c.AddOption("default", "name", "www")
+	c.AddOption("db", "port", "5432")
+
+	if v, err := c.Expand("%(scheme)s://%(host)s:%(port:443)s/ 100%%"); err != nil || v != "https://www.example.com:443/ 100%" {
+		t.Errorf("Expand returned %q, %v", v, err)
+	}
+	if v, err := c.Expand("%([db]port)s"); err != nil || v != "5432" {
+		t.Errorf("Expand of a qualified reference returned %q, %v", v, err)
+	}
+	if _, err := c.Expand("%(missing)s"); err == nil {
+		t.Error("Expand of a missing reference returned no error")
+	}
+}
+
+func TestExtends(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "timeout", "30")
+	c.AddOption("base", "host", "example.com")
+	c.AddOption("base", "url", "https://%(host)s:%(port)s/%(timeout)s")
+	c.AddOption("base", "port", "80")
+	c.AddOption("staging", ExtendsOption, "base")
+	c.AddOption("staging", "port", "8080")
+	c.AddOption("prod", ExtendsOption, "Staging")
+	c.AddOption("prod", "host", "prod.example.com")
+
+	tests := []struct{ option, want string }{
+		{"host", "prod.example.com"},
+		{"port", "8080"},
+		{"url", "https://prod.example.com:8080/30"},
+	}
+	for _, tt := range tests {
+		if v, err := c.GetString("prod", tt.option); err != nil || v != tt.want {
+			t.Errorf("prod.%s = %q, %v, want %q", tt.option, v, err, tt.want)
+		}
+	}
+	if !c.HasOption("prod", "url") || !c.HasOption("prod", "timeout") || c.HasOption("prod", "missing") {
+		t.Error("HasOption does not follow the sections extended")
+	}
+	for _, section := range []string{"base", "prod"} {
+		if _, err := c.GetString(section, "timeout"); !isMissing(err) {
+			t.Errorf("GetString(%s, timeout) read the default section: %v", section, err)
+		}
+	}
+
+	options, _ := c.GetOptions("prod")
+	if strings.Join(options, ",") != "timeout,host,url,port,port,host" {
+		t.Errorf("GetOptions(prod) = %v", options)
+	}
+	if m, err := c.GetSectionMap("prod"); err != nil || m["port"] != "8080" || m["timeout"] != "30" || len(m) != 4 {
+		t.Errorf("GetSectionMap(prod) = %v, %v", m, err)
+	}
+	if r, err := c.GetAll("prod", "port"); err != nil || r.Local != "8080" || !r.HasLocal {
+		t.Errorf("GetAll(prod, port) = %+v, %v", r, err)
+	}
+	if _, source, err := c.GetStringSource("prod", "url"); err != nil || source != SourceSet {
+		t.Errorf("GetStringSource(prod, url) = %q, %v", source, err)
+	}
+	allowed := map[string][]string{"default": {"timeout"}, "base": {AnyOption}, "staging": {"port"}, "prod": {"host"}}
+	if unknown := c.CheckAgainstSchema(allowed); len(unknown) != 0 {
+		t.Errorf("CheckAgainstSchema reported %v", unknown)
+	}
+
+	c.AddOption("base", ExtendsOption, "prod")
+	_, err := c.GetString("prod", "missing")
+	if e, ok := err.(GetError); !ok || e.Reason != InheritanceCycle || e.Value != "prod -> staging -> base -> prod" {
+		t.Errorf("GetString with an inheritance cycle returned %v", err)
+	}
+	if _, err = c.GetOptions("prod"); err == nil {
+		t.Error("GetOptions with an inheritance cycle returned no error")
+	}
+}
+
+func TestGetLines(t *testing.T) {
+	c, err := ReadConfigBytes([]byte("[allow]\nhosts = a.example.com\n  b.example.com, c.example.com\n  %(extra)s\nextra = d.example.com\nempty =\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.example.com", "b.example.com, c.example.com", "d.example.com"}
+	if lines, err := c.GetLines("allow", "hosts"); err != nil || !reflect.DeepEqual(lines, want) {
+		t.Errorf("GetLines = %q, %v, want %q", lines, err, want)
+	}
+	c.AddOption("allow", "trailing", "x\n\n \n")
+	if lines, _ := c.GetLines("allow", "trailing"); !reflect.DeepEqual(lines, []string{"x"}) {
+		t.Errorf("GetLines kept trailing empty lines: %q", lines)
+	}
+	if lines, err := c.GetLines("allow", "empty"); err != nil || len(lines) != 0 {
+		t.Errorf("GetLines of an empty value = %q, %v", lines, err)
+	}
+	if _, err := c.GetLines("allow", "missing"); err == nil {
+		t.Error("GetLines of a missing option returned no error")
+	}
+}
+
+func TestGetStringFunc(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("service", "name", "api")
+	c.AddOption("service", "broken", "%(broken)s")
+
+	calls := 0
+	fallback := func() string {
+		calls++
+		return "generated"
+	}
+
+	if v, err := c.GetStringFunc("service", "name", fallback); err != nil || v != "api" || calls != 0 {
+		t.Errorf("GetStringFunc of a present option = %q, %v after %d calls", v, err, calls)
+	}
+	if v, err := c.GetStringFunc("service", "id", fallback); err != nil || v != "generated" || calls != 1 {
+		t.Errorf("GetStringFunc of a missing option = %q, %v after %d calls", v, err, calls)
+	}
+	if v, err := c.GetStringFunc("other", "id", fallback); err != nil || v != "generated" || calls != 2 {
+		t.Errorf("GetStringFunc of a missing section = %q, %v after %d calls", v, err, calls)
+	}
+	_, err := c.GetStringFunc("service", "broken", fallback)
+	if e, ok := err.(GetError); !ok || e.Reason != MaxDepthReached || calls != 2 {
+		t.Errorf("GetStringFunc of a value that cannot be unfolded returned %v after %d calls", err, calls)
+	}
+}
+
+func TestAddOptionStrict(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "localhost")
+	c.AddOption("db", "user", "admin")
+
+	err := c.AddOptionStrict("DB", "User", "root")
+	if e, ok := err.(GetError); !ok || e.Reason != AlreadyExists || e.Section != "db" || e.Option != "user" {
+		t.Errorf("AddOptionStrict of an existing option returned %v", err)
+	}
+	if v, _ := c.GetRawString("db", "user"); v != "admin" {
+		t.Errorf("AddOptionStrict overwrote the existing value: %q", v)
+	}
+
+	if err = c.AddOptionStrict("db", "host", "db.example.com"); err != nil {
+		t.Errorf("AddOptionStrict of an option of the default section returned %v", err)
+	}
+	if err = c.AddOptionStrict("cache", "size", "64"); err != nil || !c.HasSection("cache") {
+		t.Errorf("AddOptionStrict in a new section returned %v", err)
+	}
+	if v, _ := c.GetRawString("cache", "size"); v != "64" {
+		t.Errorf("cache.size = %q", v)
+	}
+}
+
+func TestReadString(t *testing.T) {
+	c, err := ReadString("name = app\n[db]\nhost = localhost\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetString("db", "host"); v != "localhost" {
+		t.Errorf("db.host = %q", v)
+	}
+
+	_, err = ReadString("[db]\nhost = localhost\n[broken\n")
+	if e, ok := err.(ReadError); !ok || e.Reason != MalformedSection || e.LineNo != 3 {
+		t.Errorf("ReadString of a malformed section header returned %v", err)
+	}
+}
+
+func TestGetStringListUnfoldsElements(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "primary", "db1.example.com")
+	c.AddOption("default", "label", "replica, read-only")
+	c.AddOption("cluster", "hosts", "%(primary)s, %(label)s,%(missing:none)s, %(backup:a,b)s")
+
+	want := []string{"db1.example.com", "replica, read-only", "none", "a,b"}
+	if list, err := c.GetStringList("cluster", "hosts"); err != nil || !reflect.DeepEqual(list, want) {
+		t.Errorf("GetStringList = %q, %v, want %q", list, err, want)
+	}
+
+	c.AddOption("cluster", "broken", "a, %(undefined)s")
+	if _, err := c.GetStringList("cluster", "broken"); err == nil {
+		t.Error("GetStringList of an element that cannot be unfolded returned no error")
+	}
+}
+
+func TestFindReferences(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "url", "https://%(HOST)s/")
+	c.AddOption("db", "host", "db.%(domain:local)s")
+	c.AddOption("db", "dsn", "%([default]host:x)s %(hostname)s")
+	c.AddOption("db", "note", "100%%(host)s")
+
+	want := []OptionRef{{"default", "url"}, {"db", "dsn"}}
+	if refs := c.FindReferences("Host"); !reflect.DeepEqual(refs, want) {
+		t.Errorf("FindReferences(Host) = %v, want %v", refs, want)
+	}
+	if refs := c.FindReferences("missing"); refs != nil {
+		t.Errorf("FindReferences(missing) = %v", refs)
+	}
+
+	c = NewConfigFile()
+	c.CaseSensitive = true
+	c.AddOption("default", "url", "%(HOST)s %(host)s")
+	c.AddOption("default", "alt", "%(HOST)s")
+	if refs := c.FindReferences("host"); !reflect.DeepEqual(refs, []OptionRef{{"default", "url"}}) {
+		t.Errorf("FindReferences with CaseSensitive = %v", refs)
+	}
+}
+
+func TestRenameVariable(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "example.com")
+	c.AddOption("default", "url", "https://%(Host)s/%(host)s")
+	c.AddOption("db", "dsn", "%([default]host:localhost)s %(hostname)s")
+	c.AddOption("db", "note", "100%%(host)s")
+	c.ClearDirty()
+
+	if n, err := c.RenameVariable("HOST", "server"); err != nil || n != 3 {
+		t.Errorf("RenameVariable returned %d, %v, want 3", n, err)
+	}
+	tests := []struct{ section, option, want string }{
+		{"default", "url", "https://%(server)s/%(server)s"},
+		{"db", "dsn", "%([default]server:localhost)s %(hostname)s"},
+		{"db", "note", "100%%(host)s"},
+		{"default", "host", "example.com"},
+	}
+	for _, tt := range tests {
+		if v, _ := c.GetRawString(tt.section, tt.option); v != tt.want {
+			t.Errorf("%s.%s = %q, want %q", tt.section, tt.option, v, tt.want)
+		}
+	}
+	if want := []OptionRef{{"db", "dsn"}, {"default", "url"}}; !reflect.DeepEqual(c.Dirty(), want) {
+		t.Errorf("Dirty() = %v, want %v", c.Dirty(), want)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "url", "pg://%(host)s")
+	c.Freeze()
+	if !c.Frozen() {
+		t.Fatal("Frozen() = false after Freeze")
+	}
+
+	if _, err := c.RemoveOption("db", "host"); err != ErrFrozen {
+		t.Errorf("RemoveOption returned %v", err)
+	}
+	if _, err := c.RemoveSection("db"); err != ErrFrozen {
+		t.Errorf("RemoveSection returned %v", err)
+	}
+	if err := c.Merge(NewConfigFile()); err != ErrFrozen {
+		t.Errorf("Merge returned %v", err)
+	}
+	if err := c.Read(strings.NewReader("[db]\nhost = other\n")); err != ErrFrozen {
+		t.Errorf("Read returned %v", err)
+	}
+	if err := c.AddOptionStrict("db", "port", "5432"); err != ErrFrozen {
+		t.Errorf("AddOptionStrict returned %v", err)
+	}
+
+	for name, fn := range map[string]func() error{
+		"AddOption":          func() error { _, err := c.AddOption("db", "host", "example.com"); return err },
+		"AddSection":         func() error { _, err := c.AddSection("cache"); return err },
+		"SetInt":             func() error { _, err := c.SetInt("db", "port", 5432); return err },
+		"SetByPath":          func() error { _, err := c.SetByPath("db.port", "5432"); return err },
+		"SetSection":         func() error { return c.SetSection("db", map[string]string{}) },
+		"Clear":              func() error { return c.Clear() },
+		"ImportEnviron":      func() error { return c.ImportEnviron("env", "GOCONF_FREEZE_") },
+		"RenameVariable":     func() error { _, err := c.RenameVariable("host", "server"); return err },
+		"GetOrCreateSection": func() error { _, err := c.GetOrCreateSection("cache"); return err },
+	} {
+		if err := fn(); err != ErrFrozen {
+			t.Errorf("%s on a frozen configuration returned %v", name, err)
+		}
+	}
+	if m, err := c.GetOrCreateSection("db"); err != nil || m["host"] != "localhost" {
+		t.Errorf("GetOrCreateSection(db) of a frozen configuration = %v, %v", m, err)
+	}
+
+	if v, err := c.GetString("db", "url"); err != nil || v != "pg://localhost" {
+		t.Errorf("GetString of a frozen configuration = %q, %v", v, err)
+	}
+	if c.HasSection("cache") || c.HasOption("db", "port") {
+		t.Error("a frozen configuration was changed")
+	}
+
+	d := c.Copy()
+	if added, err := d.AddOption("db", "port", "5432"); d.Frozen() || err != nil || !added {
+		t.Error("a copy of a frozen configuration is frozen")
+	}
+}
+
+func TestByPath(t *testing.T) {
+	c := NewConfigFile()
+	if inserted, err := c.SetByPath("db.pool.size", "10"); err != nil || !inserted {
+		t.Errorf("SetByPath(db.pool.size) of a new option returned %v, %v", inserted, err)
+	}
+	if inserted, err := c.SetByPath("host", "example.com"); err != nil || !inserted {
+		t.Errorf("SetByPath(host) of a new option returned %v, %v", inserted, err)
+	}
+	if v, _ := c.GetRawString("db.pool", "size"); v != "10" {
+		t.Errorf("db.pool.size was set to %q", v)
+	}
+	if v, _ := c.GetRawString("default", "host"); v != "example.com" {
+		t.Errorf("host was set to %q", v)
+	}
+
+	c.AddOption("db", "url", "pg://%(host)s")
+	tests := []struct{ path, want string }{
+		{"db.url", "pg://example.com"},
+		{"DB.Pool.Size", "10"},
+		{"host", "example.com"},
+	}
+	for _, tt := range tests {
+		if v, err := c.GetByPath(tt.path); err != nil || v != tt.want {
+			t.Errorf("GetByPath(%q) = %q, %v, want %q", tt.path, v, err, tt.want)
+		}
+	}
+	if _, err := c.GetByPath("db.missing"); !isMissing(err) {
+		t.Errorf("GetByPath of a missing option returned %v", err)
+	}
+}
+
+func TestOmitDefault(t *testing.T) {
+	c, err := ReadString("# global settings\nlog = debug\n\n[db]\nhost = localhost\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(c.WriteConfigBytes("")); !strings.Contains(s, "log=debug") {
+		t.Errorf("the default section is not written by default:\n%s", s)
+	}
+
+	c.OmitDefault = true
+	s := string(c.WriteConfigBytes(""))
+	if strings.Contains(s, "log") || strings.Contains(s, "global settings") {
+		t.Errorf("the default section is written with OmitDefault:\n%s", s)
+	}
+	if !strings.HasPrefix(s, "[db]\nhost=localhost\n") {
+		t.Errorf("the named sections are not written with OmitDefault:\n%s", s)
+	}
+}
+
+func TestAllowRepeatedKeys(t *testing.T) {
+	input := "[pool]\nserver = a\nserver = b\n[other]\nserver = x\n[pool]\nserver = c\n"
+
+	c := NewConfigFile()
+	if err := c.Read(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetString("pool", "server"); v != "c" {
+		t.Errorf("a repeated key without AllowRepeatedKeys = %q, want the last value", v)
+	}
+
+	c = NewConfigFile()
+	c.AllowRepeatedKeys = true
+	if err := c.Read(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := c.GetStringList("pool", "server"); err != nil || !reflect.DeepEqual(list, []string{"a", "b", "c"}) {
+		t.Errorf("GetStringList of a repeated key = %q, %v", list, err)
+	}
+	if v, _ := c.GetString("other", "server"); v != "x" {
+		t.Errorf("other.server = %q", v)
+	}
+	if err := c.Read(strings.NewReader("[pool]\nserver = d\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.GetString("pool", "server"); v != "d" {
+		t.Errorf("a later read did not overwrite the repeated key: %q", v)
+	}
+
+	c = NewConfigFile()
+	c.AllowRepeatedKeys = true
+	c.StrictDuplicates = true
+	if err := c.Read(strings.NewReader(input)); err == nil {
+		t.Error("StrictDuplicates did not take precedence over AllowRepeatedKeys")
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("net", "v4", "192.0.2.1")
+	c.AddOption("net", "v6", "2001:db8::1")
+	c.AddOption("net", "subnet", "%(v4)s/24")
+	c.AddOption("net", "subnet6", "2001:db8::/32")
+	c.AddOption("net", "bad", "192.0.2.256")
+
+	if ip, err := c.GetIP("net", "v4"); err != nil || !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("GetIP(v4) = %v, %v", ip, err)
+	}
+	if ip, err := c.GetIP("net", "v6"); err != nil || ip.String() != "2001:db8::1" {
+		t.Errorf("GetIP(v6) = %v, %v", ip, err)
+	}
+	if ip, network, err := c.GetCIDR("net", "subnet"); err != nil || ip.String() != "192.0.2.1" || network.String() != "192.0.2.0/24" {
+		t.Errorf("GetCIDR(subnet) = %v, %v, %v", ip, network, err)
+	}
+	if _, network, err := c.GetCIDR("net", "subnet6"); err != nil || network.String() != "2001:db8::/32" {
+		t.Errorf("GetCIDR(subnet6) = %v, %v", network, err)
+	}
+
+	_, err := c.GetIP("net", "bad")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "ip" {
+		t.Errorf("GetIP of an invalid address returned %v", err)
+	}
+	_, _, err = c.GetCIDR("net", "v4")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "cidr" {
+		t.Errorf("GetCIDR of an address without prefix returned %v", err)
+	}
+}
+
+func TestGetURL(t *testing.T) {
+	c := NewConfigFile()
+	c.AddOption("default", "host", "api.example.com")
+	c.AddOption("svc", "endpoint", "https://%(host)s:8443/v1?debug=1")
+	c.AddOption("svc", "bare", "example.com")
+	c.AddOption("svc", "bad", "http://[::1")
+
+	u, err := c.GetURL("svc", "endpoint")
+	if err != nil || u.Scheme != "https" || u.Host != "api.example.com:8443" || u.Path != "/v1" || u.Query().Get("debug") != "1" {
+		t.Errorf("GetURL(endpoint) = %v, %v", u, err)
+	}
+	if u, err = c.GetAbsoluteURL("svc", "endpoint"); err != nil || u.Hostname() != "api.example.com" {
+		t.Errorf("GetAbsoluteURL(endpoint) = %v, %v", u, err)
+	}
+
+	if u, err = c.GetURL("svc", "bare"); err != nil || u.Path != "example.com" {
+		t.Errorf("GetURL(bare) = %v, %v", u, err)
+	}
+	_, err = c.GetAbsoluteURL("svc", "bare")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "url" {
+		t.Errorf("GetAbsoluteURL of a URL without scheme returned %v", err)
+	}
+	_, err = c.GetURL("svc", "bad")
+	if e, ok := err.(GetError); !ok || e.Reason != CouldNotParse || e.ValueType != "url" {
+		t.Errorf("GetURL of an invalid URL returned %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package conf
+
+// OptionChange describes an option that differs between two configurations.
+// Old is empty for an added option and New is empty for a removed one.
+type OptionChange struct {
+	Section string
+	Option  string
+	Old     string
+	New     string
+}
+
+// ConfigDiff lists the differences between two configurations, as returned by Diff.
+type ConfigDiff struct {
+	AddedSections   []string
+	RemovedSections []string
+	Added           []OptionChange // Options only in the new configuration.
+	Removed         []OptionChange // Options only in the old configuration.
+	Changed         []OptionChange // Options whose raw values differ.
+}
+
+// Empty reports whether the two configurations compared were equal.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.AddedSections) == 0 && len(d.RemovedSections) == 0 &&
+		len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the configuration, taken as the old one, with other, the new one.
+// Raw values are compared, and the default section is compared like any other.
+// Removed and changed options are listed in the insertion order of the configuration,
+// added ones in the insertion order of other.
+func (c *ConfigFile) Diff(other *ConfigFile) *ConfigDiff {
+	other = other.Copy() // snapshot, so that only one lock is held at a time
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	d := new(ConfigDiff)
+	for _, section := range c.sections {
+		newOptions, ok := other.data[section]
+		if !ok {
+			d.RemovedSections = append(d.RemovedSections, section)
+		}
+		for _, option := range c.options[section] {
+			oldValue := c.data[section][option]
+			newValue, ok := newOptions[option]
+			switch {
+			case !ok:
+				d.Removed = append(d.Removed, OptionChange{section, option, oldValue, ""})
+			case newValue != oldValue:
+				d.Changed = append(d.Changed, OptionChange{section, option, oldValue, newValue})
+			}
+		}
+	}
+	for _, section := range other.sections {
+		oldOptions, ok := c.data[section]
+		if !ok {
+			d.AddedSections = append(d.AddedSections, section)
+		}
+		for _, option := range other.options[section] {
+			if _, ok := oldOptions[option]; !ok {
+				d.Added = append(d.Added, OptionChange{section, option, "", other.data[section][option]})
+			}
+		}
+	}
+
+	return d
+}
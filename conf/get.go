@@ -1,19 +1,56 @@
 package conf
 
 import (
+	"bytes"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-// GetSections returns the list of sections in the configuration.
-// (The default section always exists.)
+// GetSections returns the list of sections in the configuration, in the order
+// they were added. (The default section always exists.)
 func (c *ConfigFile) GetSections() (sections []string) {
-	sections = make([]string, len(c.data))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	i := 0
-	for s, _ := range c.data {
-		sections[i] = s
-		i++
+	sections = make([]string, len(c.sections))
+	copy(sections, c.sections)
+
+	return sections
+}
+
+// GetSectionList returns the sections of the section array name, read from [[name]]
+// headers, in the order they appeared: name.0, name.1, and so on.
+// It returns an empty list if there is no such section array.
+func (c *ConfigFile) GetSectionList(name string) (sections []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sections = make([]string, len(c.arrays[c.fold(name)]))
+	copy(sections, c.arrays[c.fold(name)])
+
+	return sections
+}
+
+// GetSectionsWithPrefix returns the sections whose name starts with prefix, in the order
+// they were added, e.g. "cache.redis" and "cache.memcached" for the prefix "cache.".
+// The prefix is matched without regard to case, unless CaseSensitive is set.
+func (c *ConfigFile) GetSectionsWithPrefix(prefix string) (sections []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	prefix = c.fold(prefix)
+	sections = []string{}
+	for _, section := range c.sections {
+		if strings.HasPrefix(section, prefix) {
+			sections = append(sections, section)
+		}
 	}
 
 	return sections
@@ -22,51 +59,224 @@ func (c *ConfigFile) GetSections() (sections []string) {
 // HasSection checks if the configuration has the given section.
 // (The default section always exists.)
 func (c *ConfigFile) HasSection(section string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if section == "" {
 		section = "default"
 	}
-	_, ok := c.data[strings.ToLower(section)]
+	_, ok := c.data[c.fold(section)]
 
 	return ok
 }
 
 // GetOptions returns the list of options available in the given section.
 // It returns an error if the section does not exist and an empty list if the section is empty.
-// Options within the default section are also included.
+// Options within the default section, and within the sections it extends (see
+// ExtendsOption), are also included. Options are listed in the order they were
+// added, those of the default section first, then those of the sections extended, the
+// farthest first.
 func (c *ConfigFile) GetOptions(section string) (options []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if section == "" {
 		section = "default"
 	}
-	section = strings.ToLower(section)
+	section = c.fold(section)
 
 	if _, ok := c.data[section]; !ok {
 		return nil, GetError{SectionNotFound, "", "", section, ""}
 	}
 
-	options = make([]string, len(c.data[DefaultSection])+len(c.data[section]))
-	i := 0
-	for s, _ := range c.data[DefaultSection] {
-		options[i] = s
-		i++
+	path, err := c.visible(section)
+	if err != nil {
+		return nil, err
 	}
-	for s, _ := range c.data[section] {
-		options[i] = s
-		i++
+
+	options = []string{}
+	for i := len(path) - 1; i >= 0; i-- {
+		options = appendOptions(options, c.options[path[i]])
 	}
 
 	return options, nil
 }
 
+// appendOptions appends the options, but ExtendsOption, to list.
+func appendOptions(list []string, options []string) []string {
+	for _, option := range options {
+		if option != ExtendsOption {
+			list = append(list, option)
+		}
+	}
+	return list
+}
+
+// GetSection returns a copy of the options defined in the section, without unfolding.
+// It returns an error if the section does not exist.
 func (c *ConfigFile) GetSection(section string) (options ConfigSection, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = "default"
+	}
+	section = c.fold(section)
+
+	if _, ok := c.data[section]; !ok {
+		return nil, GetError{SectionNotFound, "", "", section, ""}
+	}
+
+	options = make(ConfigSection, len(c.data[section]))
+	for option, value := range c.data[section] {
+		options[option] = value
+	}
+
+	return options, nil
+}
+
+// GetOptionsLocal returns the list of options defined in the given section itself, in the
+// order they were added, leaving out those inherited from the default section.
+// It returns an error if the section does not exist and an empty list if the section is empty.
+func (c *ConfigFile) GetOptionsLocal(section string) (options []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = "default"
+	}
+	section = c.fold(section)
+
+	if _, ok := c.data[section]; !ok {
+		return nil, GetError{SectionNotFound, "", "", section, ""}
+	}
+
+	options = appendOptions(make([]string, 0, len(c.options[section])), c.options[section])
+
+	return options, nil
+}
+
+// GetSectionMap returns the unfolded values of every option in the section, including the
+// options of the sections it extends and of the default section; options of the section
+// override those of the sections it extends, which override those of the default section.
+// The returned map is a copy. It returns an error if the section does not exist or a value
+// cannot be unfolded.
+func (c *ConfigFile) GetSectionMap(section string) (options map[string]string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if section == "" {
 		section = "default"
 	}
-	section = strings.ToLower(section)
+	section = c.fold(section)
 
 	if _, ok := c.data[section]; !ok {
 		return nil, GetError{SectionNotFound, "", "", section, ""}
 	}
-	return c.data[section], nil
+
+	path, err := c.visible(section)
+	if err != nil {
+		return nil, err
+	}
+
+	options = make(map[string]string)
+	for _, s := range path {
+		for option, value := range c.data[s] {
+			if _, ok := options[option]; ok || option == ExtendsOption {
+				continue
+			}
+			if options[option], err = c.expand(section, option, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return options, nil
+}
+
+// GetPrefixedOptions returns the unfolded values of the options of the section whose name
+// starts with prefix, keyed by their name without the prefix: with the options
+// server.1.host and server.1.port, the prefix "server.1." gives the keys host and port.
+// As for GetSectionMap, options of the sections extended and of the default section are
+// included, and options of the section override them. It returns an error if the section
+// does not exist or a value cannot be unfolded.
+func (c *ConfigFile) GetPrefixedOptions(section string, prefix string) (options map[string]string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = "default"
+	}
+	section = c.fold(section)
+	prefix = c.fold(prefix)
+
+	if _, ok := c.data[section]; !ok {
+		return nil, GetError{SectionNotFound, "", "", section, ""}
+	}
+
+	path, err := c.visible(section)
+	if err != nil {
+		return nil, err
+	}
+
+	options = make(map[string]string)
+	for _, s := range path {
+		for option, value := range c.data[s] {
+			if !strings.HasPrefix(option, prefix) || option == ExtendsOption {
+				continue
+			}
+			if _, ok := options[option[len(prefix):]]; ok {
+				continue // overridden by a nearer section
+			}
+			if options[option[len(prefix):]], err = c.expand(section, option, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return options, nil
+}
+
+// WalkOptions calls fn with the raw value of every option, section by section in the
+// order the sections were added (the default section first) and, within a section, in
+// the order the options were added. Each option is visited once, in the section that
+// defines it. The walk stops as soon as fn returns false.
+// The configuration is read-locked during the walk, so fn must not call methods of c.
+func (c *ConfigFile) WalkOptions(fn func(section, option, rawValue string) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, section := range c.sections {
+		for _, option := range c.options[section] {
+			if !fn(section, option, c.data[section][option]) {
+				return
+			}
+		}
+	}
+}
+
+// FindReferences returns every option whose raw value holds a %(name)s reference, in the
+// order of WalkOptions. References qualified by a section, such as %([db]name)s, and
+// references with a default, such as %(name:x)s, count as well; escaped ones, such as
+// %%(name)s, do not. Names are compared without regard to case, unless CaseSensitive is set.
+func (c *ConfigFile) FindReferences(name string) (refs []OptionRef) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name = c.fold(name)
+	for _, section := range c.sections {
+		for _, option := range c.options[section] {
+			value := c.data[section][option]
+			for _, vr := range references(value) {
+				if c.fold(value[vr[4]:vr[5]]) == name {
+					refs = append(refs, OptionRef{section, option})
+					break
+				}
+			}
+		}
+	}
+
+	return refs
 }
 
 // Params: option, default_value
@@ -96,55 +306,421 @@ func (c *ConfigSection) GetInt64(params... string) int64 {
 }
 
 
-// HasOption checks if the configuration has the given option in the section.
+// HasOption checks if the configuration has the given option in the section, in a section
+// it extends (see ExtendsOption) or in the default section.
 // It returns false if either the option or section do not exist.
 func (c *ConfigFile) HasOption(section string, option string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if section == "" {
 		section = "default"
 	}
-	section = strings.ToLower(section)
-	option = strings.ToLower(option)
+	section = c.fold(section)
+	option = c.fold(option)
 
 	if _, ok := c.data[section]; !ok {
 		return false
 	}
 
 	_, okd := c.data[DefaultSection][option]
-	_, oknd := c.data[section][option]
+	s, _ := c.extended(section, option)
 
-	return okd || oknd
+	return okd || s != ""
 }
 
-// GetRawString gets the (raw) string value for the given option in the section.
+// HasAnyOption checks if at least one of the sections has the option, either defining
+// it or inheriting it from the default section, as HasOption does. It returns false if
+// no section is given.
+func (c *ConfigFile) HasAnyOption(option string, sections ...string) bool {
+	for _, section := range sections {
+		if c.HasOption(section, option) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRawString gets the (raw) string value for the given option in the section, or in
+// the nearest section it extends defining the option (see ExtendsOption).
 // The raw string value is not subjected to unfolding, which was illustrated in the beginning of this documentation.
 // It returns an error if either the section or the option do not exist.
 func (c *ConfigFile) GetRawString(section string, option string) (value string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.getRawString(section, option)
+}
+
+// getRawString is GetRawString without locking.
+func (c *ConfigFile) getRawString(section string, option string) (value string, err error) {
 	if section == "" {
 		section = "default"
 	}
 
-	section = strings.ToLower(section)
-	option = strings.ToLower(option)
+	section = c.fold(section)
+	option = c.fold(option)
 
 	if _, ok := c.data[section]; ok {
-		if value, ok = c.data[section][option]; ok {
-			return value, nil
+		s, err := c.extended(section, option)
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			return c.data[s][option], nil
 		}
 		return "", GetError{OptionNotFound, "", "", section, option}
 	}
 	return "", GetError{SectionNotFound, "", "", section, option}
 }
 
+// GetStringExpand has the same behaviour as GetString but passes the name of every
+// %(name)s reference to an option that does not exist to resolve, and uses the value
+// it returns as is; the name of a %([section]name)s reference is passed as "[section]name".
+// If resolve returns false, an OptionNotFound error is returned as GetString would.
+func (c *ConfigFile) GetStringExpand(section string, option string, resolve func(name string) (string, bool)) (value string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	value, err = c.getRawString(section, option)
+	if err != nil {
+		return "", err
+	}
+
+	if section == "" {
+		section = "default"
+	}
+
+	return c.expandWith(c.fold(section), c.fold(option), value, unfolding{resolve: resolve})
+}
+
+// GetStringDepth has the same behaviour as GetString but limits the nesting of references
+// to depth instead of DepthValues. As DepthValues, depth counts the options along a chain of
+// references, the option itself included: with a depth of 2, the value may refer to options
+// holding no reference themselves. It returns a CouldNotParse error if depth is less than 1.
+func (c *ConfigFile) GetStringDepth(section string, option string, depth int) (value string, err error) {
+	if depth < 1 {
+		return "", GetError{CouldNotParse, "depth", strconv.Itoa(depth), section, option}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if value, err = c.getRawString(section, option); err != nil {
+		return "", err
+	}
+	if section == "" {
+		section = "default"
+	}
+
+	return c.expandWith(c.fold(section), c.fold(option), value, unfolding{depth: depth})
+}
+
+// Expand unfolds the references in template as GetString unfolds those of a value of the
+// default section, without storing template as an option:
+//
+//	c.Expand("%(scheme)s://%(host)s:%(port:443)s/")
+//
+// It returns an error if a reference cannot be unfolded.
+func (c *ConfigFile) Expand(template string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.expand(DefaultSection, "", template)
+}
+
+// GetRawStringDefault has the same behaviour as GetRawString but returns fallback when
+// either the section or the option do not exist.
+func (c *ConfigFile) GetRawStringDefault(section string, option string, fallback string) string {
+	value, err := c.GetRawString(section, option)
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
 // GetString gets the string value for the given option in the section.
 // If the value needs to be unfolded (see e.g. %(host)s example in the beginning of this documentation),
 // then GetString does this unfolding automatically, up to DepthValues number of iterations.
+// A reference may give a default, used when the option does not exist: %(host:localhost)s.
+// The default extends from the first colon to the closing parenthesis, so it may contain
+// colons but no parenthesis.
+// A reference may name the section holding the option: %([database]host)s is the option
+// host of the section database, or of the default section if database does not define it.
+// A literal percent sign is written as "%%", so "%%(host)s" yields "%(host)s".
+// If ExpandEnv is set, ${NAME} references are replaced by the value of the environment
+// variable NAME; references to unset variables are left as they are.
 // It returns an error if either the section or the option do not exist, or the unfolding cycled.
 func (c *ConfigFile) GetString(section string, option string) (value string, err error) {
-	value, err = c.GetRawString(section, option)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.EnableCache {
+		return c.getString(section, option)
+	}
+
+	ref := OptionRef{section, c.fold(option)}
+	if section == "" {
+		ref.Section = DefaultSection
+	}
+	ref.Section = c.fold(ref.Section)
+
+	c.cacheMu.Lock()
+	value, ok := c.cache[ref]
+	c.cacheMu.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	if value, err = c.getString(section, option); err != nil {
+		return "", err
+	}
+
+	c.cacheMu.Lock()
+	if c.cache == nil {
+		c.cache = make(map[OptionRef]string)
+	}
+	c.cache[ref] = value
+	c.cacheMu.Unlock()
+
+	return value, nil
+}
+
+// getString is GetString without locking.
+func (c *ConfigFile) getString(section string, option string) (value string, err error) {
+	value, err = c.getRawString(section, option)
+	if err != nil {
+		return "", err
+	}
+
+	if section == "" {
+		section = "default"
+	}
+
+	return c.expand(c.fold(section), c.fold(option), value)
+}
+
+// GetByPath has the same behaviour as GetString for the option named by path, written
+// "section.option". The path is split on its last dot, so that "db.pool.size" names the
+// option size of the section db.pool; an option whose name holds a dot cannot be reached.
+// A path without a dot, such as "host", names an option of the default section.
+func (c *ConfigFile) GetByPath(path string) (value string, err error) {
+	section, option := splitPath(path)
+	return c.GetString(section, option)
+}
+
+// splitPath splits path as described for GetByPath.
+func splitPath(path string) (section string, option string) {
+	i := strings.LastIndex(path, ".")
+	if i == -1 {
+		return DefaultSection, path
+	}
+	return path[:i], path[i+1:]
+}
+
+// Sources reported by GetStringSource for values that were not read from a file.
+const (
+	SourceReader  = "<reader>"  // Read from an io.Reader, including JSON.
+	SourceSet     = "<set>"     // Set by AddOption or another setter.
+	SourceEnviron = "<environ>" // Imported by ImportEnviron.
+)
+
+// GetStringSource has the same behaviour as GetString but also reports where the value
+// was last defined: the path of the file it was read from, as passed to ReadConfigFile or
+// ReadFiles (or reached by an include directive) and cleaned by filepath.Clean, or one of
+// SourceReader, SourceSet or SourceEnviron.
+// Merged options keep the source they had in the other configuration.
+func (c *ConfigFile) GetStringSource(section string, option string) (value string, source string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if value, err = c.getString(section, option); err != nil {
+		return "", "", err
+	}
+	if section == "" {
+		section = "default"
+	}
+	s, _ := c.extended(c.fold(section), c.fold(option))
+
+	return value, c.sources[OptionRef{s, c.fold(option)}], nil
+}
+
+// Resolution describes where an option is defined, as returned by GetAll.
+type Resolution struct {
+	Local      string // Raw value defined in the section itself, or in a section it extends.
+	HasLocal   bool
+	Default    string // Raw value defined in the default section.
+	HasDefault bool
+	Value      string // Effective value: Local unfolded, or Default unfolded if not HasLocal.
+}
+
+// GetAll reports both the raw values of the option in the section and in the default
+// section, and its effective value once the default section is inherited. For an option
+// only the default section defines, Value is the unfolded default value, which GetString
+// does not return as it does not read the default section.
+// It returns an error if the section does not exist, if the option is defined in neither
+// section, or if unfolding fails.
+func (c *ConfigFile) GetAll(section string, option string) (r Resolution, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = "default"
+	}
+	section = c.fold(section)
+	option = c.fold(option)
+
+	if _, ok := c.data[section]; !ok {
+		return r, GetError{SectionNotFound, "", "", section, option}
+	}
+
+	s, err := c.extended(section, option)
+	if err != nil {
+		return r, err
+	}
+	r.Local, r.HasLocal = c.data[s][option]
+	r.Default, r.HasDefault = c.data[DefaultSection][option]
+
+	switch {
+	case r.HasLocal:
+		r.Value, err = c.getString(section, option)
+	case r.HasDefault:
+		r.Value, err = c.getString(DefaultSection, option)
+	default:
+		err = GetError{OptionNotFound, "", "", section, option}
+	}
+
+	return r, err
+}
+
+// GetStringDefault has the same behaviour as GetString but returns fallback
+// instead of an error when the section or the option do not exist
+// (GetError reasons SectionNotFound and OptionNotFound).
+// Any other error, such as MaxDepthReached while unfolding, indicates a broken
+// configuration and is still returned.
+func (c *ConfigFile) GetStringDefault(section string, option string, fallback string) (value string, err error) {
+	value, err = c.GetString(section, option)
+	if isMissing(err) {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+// GetStringFunc has the same behaviour as GetStringDefault but returns the value computed
+// by fallback, which is only called when the section or the option do not exist, so it
+// may be expensive. Other errors are still returned.
+func (c *ConfigFile) GetStringFunc(section string, option string, fallback func() string) (value string, err error) {
+	value, err = c.GetString(section, option)
+	if isMissing(err) {
+		return fallback(), nil
+	}
+
+	return value, err
+}
+
+// GetIntDefault has the same behaviour as GetInt but returns fallback when the section or
+// the option do not exist, as GetStringDefault does. A value that cannot be parsed is
+// still reported as a CouldNotParse error.
+func (c *ConfigFile) GetIntDefault(section string, option string, fallback int) (value int, err error) {
+	value, err = c.GetInt(section, option)
+	if isMissing(err) {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+// GetBoolDefault is GetBool with a fallback for missing options (see GetIntDefault).
+func (c *ConfigFile) GetBoolDefault(section string, option string, fallback bool) (value bool, err error) {
+	value, err = c.GetBool(section, option)
+	if isMissing(err) {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+// GetFloat64Default is GetFloat64 with a fallback for missing options (see GetIntDefault).
+func (c *ConfigFile) GetFloat64Default(section string, option string, fallback float64) (value float64, err error) {
+	value, err = c.GetFloat64(section, option)
+	if isMissing(err) {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+// GetDurationDefault is GetDuration with a fallback for missing options (see GetIntDefault).
+func (c *ConfigFile) GetDurationDefault(section string, option string, fallback time.Duration) (value time.Duration, err error) {
+	value, err = c.GetDuration(section, option)
+	if isMissing(err) {
+		return fallback, nil
+	}
+
+	return value, err
+}
+
+// GetStringNonEmpty has the same behaviour as GetString but treats an option that unfolds
+// to an empty string, such as "key =", as missing: it then uses the non-empty value of
+// the option in the default section, or else returns fallback. Errors, including
+// unfolding errors, also give fallback.
+func (c *ConfigFile) GetStringNonEmpty(section string, option string, fallback string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, s := range []string{section, DefaultSection} {
+		if value, err := c.getString(s, option); err == nil && value != "" {
+			return value
+		}
+	}
+
+	return fallback
+}
+
+// GetEnum has the same behaviour as GetString but requires the value to be one of allowed,
+// compared without regard to case unless CaseSensitive is set, and returns it as spelled
+// in allowed. Any other value is reported as a GetError with reason CouldNotParse and
+// value type "enum[...]" listing allowed, e.g. "enum[debug,info]".
+func (c *ConfigFile) GetEnum(section string, option string, allowed []string) (value string, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range allowed {
+		if a == sv || !c.CaseSensitive && strings.EqualFold(a, sv) {
+			return a, nil
+		}
+	}
+
+	return "", GetError{CouldNotParse, "enum[" + strings.Join(allowed, ",") + "]", sv, section, option}
+}
+
+// GetStringMatch has the same behaviour as GetString but also checks that the value matches
+// the regular expression pattern (use ^ and $ to match the whole value).
+// It returns the error of regexp.Compile if the pattern is invalid.
+func (c *ConfigFile) GetStringMatch(section string, option string, pattern string) (value string, err error) {
+	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return "", err
 	}
 
+	return c.GetStringRegexp(section, option, re)
+}
+
+// GetStringRegexp has the same behaviour as GetStringMatch but takes a compiled regular expression.
+func (c *ConfigFile) GetStringRegexp(section string, option string, re *regexp.Regexp) (value string, err error) {
+	value, err = c.GetString(section, option)
+	if err != nil {
+		return "", err
+	}
+
+	if !re.MatchString(value) {
+		return "", GetError{CouldNotParse, "regexp:" + re.String(), value, section, option}
+	}
+
 	return value, nil
 }
 
@@ -161,7 +737,66 @@ func (c *ConfigFile) GetInt(section string, option string) (value int, err error
 	return value, err
 }
 
-// GetFloat has the same behaviour as GetString but converts the response to float.
+// GetIntInRange has the same behaviour as GetInt but also checks that the value lies
+// between lo and hi, both inclusive. A value out of range is reported as a GetError
+// with reason CouldNotParse and value type "int[lo,hi]", e.g. "int[1,16]".
+func (c *ConfigFile) GetIntInRange(section string, option string, lo int, hi int) (value int, err error) {
+	if value, err = c.GetInt(section, option); err != nil {
+		return value, err
+	}
+	if value < lo || value > hi {
+		valueType := "int[" + strconv.Itoa(lo) + "," + strconv.Itoa(hi) + "]"
+		return value, GetError{CouldNotParse, valueType, strconv.Itoa(value), section, option}
+	}
+
+	return value, nil
+}
+
+// GetRune has the same behaviour as GetString but requires the value to be a single
+// character, which it returns. A multi-byte UTF-8 character counts as one. An empty value,
+// invalid UTF-8 or more than one character is reported as CouldNotParse.
+func (c *ConfigFile) GetRune(section string, option string) (value rune, err error) {
+	sv, err := c.GetString(section, option)
+	if err == nil {
+		var size int
+		value, size = utf8.DecodeRuneInString(sv)
+		if (value == utf8.RuneError && size <= 1) || size != len(sv) {
+			return 0, GetError{CouldNotParse, "rune", sv, section, option}
+		}
+	}
+
+	return value, err
+}
+
+// GetInt64 has the same behaviour as GetString but converts the response to int64.
+func (c *ConfigFile) GetInt64(section string, option string) (value int64, err error) {
+	sv, err := c.GetString(section, option)
+	if err == nil {
+		value, err = strconv.ParseInt(sv, 10, 64)
+		if err != nil {
+			err = GetError{CouldNotParse, "int64", sv, section, option}
+		}
+	}
+
+	return value, err
+}
+
+// GetUint64 has the same behaviour as GetString but converts the response to uint64.
+// Negative values are rejected rather than wrapped around.
+func (c *ConfigFile) GetUint64(section string, option string) (value uint64, err error) {
+	sv, err := c.GetString(section, option)
+	if err == nil {
+		value, err = strconv.ParseUint(sv, 10, 64)
+		if err != nil {
+			err = GetError{CouldNotParse, "uint64", sv, section, option}
+		}
+	}
+
+	return value, err
+}
+
+// GetFloat64 has the same behaviour as GetString but converts the response to float64.
+// Scientific notation such as "1.5e-3" is accepted; trailing characters are not.
 func (c *ConfigFile) GetFloat64(section string, option string) (value float64, err error) {
 	sv, err := c.GetString(section, option)
 	if err == nil {
@@ -175,7 +810,7 @@ func (c *ConfigFile) GetFloat64(section string, option string) (value float64, e
 }
 
 // GetBool has the same behaviour as GetString but converts the response to bool.
-// See constant BoolStrings for string values converted to bool.
+// See variable BoolStrings for string values converted to bool; the lookup is case insensitive.
 func (c *ConfigFile) GetBool(section string, option string) (value bool, err error) {
 	sv, err := c.GetString(section, option)
 	if err != nil {
@@ -189,3 +824,548 @@ func (c *ConfigFile) GetBool(section string, option string) (value bool, err err
 
 	return value, nil
 }
+
+// GetStringArray has the same behaviour as GetStringList but honors double-quoted elements,
+// which may contain the list separator, as in: "Doe, John", "Roe, Jane".
+// The quotes are removed and \" and \\ inside them stand for a quote and a backslash.
+// Unquoted elements are trimmed, and dropped if empty; quoted elements are kept verbatim.
+// An unterminated quote, or text between a closing quote and the next separator, is
+// reported as a CouldNotParse error. As for GetStringList, the raw value is split before
+// the elements are unfolded, so a reference is never split or taken for a quote.
+func (c *ConfigFile) GetStringArray(section string, option string) (list []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sv, err := c.getRawString(section, option)
+	if err != nil {
+		return nil, err
+	}
+	if section == "" {
+		section = "default"
+	}
+
+	elems, quoted, ok := splitQuoted(sv, c.listSeparator())
+	if !ok {
+		return nil, GetError{CouldNotParse, "array", sv, section, option}
+	}
+	list = []string{}
+	for i, s := range elems {
+		if s, err = c.expand(c.fold(section), c.fold(option), s); err != nil {
+			return nil, err
+		}
+		if !quoted[i] {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// GetIntSlice has the same behaviour as GetStringList but converts every element to int.
+// If any element cannot be parsed, no list is returned.
+func (c *ConfigFile) GetIntSlice(section string, option string) (values []int, err error) {
+	list, err := c.GetStringList(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	values = make([]int, len(list))
+	for i, s := range list {
+		if values[i], err = strconv.Atoi(s); err != nil {
+			return nil, GetError{CouldNotParse, "int", s, section, option}
+		}
+	}
+
+	return values, nil
+}
+
+// GetDuration has the same behaviour as GetString but converts the response to time.Duration.
+// The value must be a number followed by a unit suffix ("ns", "us", "ms", "s", "m" or "h"),
+// as accepted by time.ParseDuration, e.g. "30s" or "1h30m".
+// A bare number without a unit (including "0") is rejected as ambiguous.
+func (c *ConfigFile) GetDuration(section string, option string) (value time.Duration, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, ferr := strconv.ParseFloat(sv, 64); ferr == nil {
+		return 0, GetError{CouldNotParse, "duration", sv, section, option}
+	}
+	if value, err = time.ParseDuration(sv); err != nil {
+		return 0, GetError{CouldNotParse, "duration", sv, section, option}
+	}
+
+	return value, nil
+}
+
+// GetTime has the same behaviour as GetString but parses the response as an RFC 3339
+// timestamp, such as "2016-01-02T15:04:05+01:00". The time keeps the offset of the value.
+func (c *ConfigFile) GetTime(section string, option string) (value time.Time, err error) {
+	return c.GetTimeFormat(section, option, time.RFC3339)
+}
+
+// GetTimeFormat has the same behaviour as GetTime but parses the response with layout,
+// as time.Parse does: the time keeps the offset of the value, and is in UTC if layout
+// has no time zone.
+func (c *ConfigFile) GetTimeFormat(section string, option string, layout string) (value time.Time, err error) {
+	sv, err := c.GetString(section, option)
+	if err == nil {
+		value, err = time.Parse(layout, sv)
+		if err != nil {
+			err = GetError{CouldNotParse, "time", sv, section, option}
+		}
+	}
+
+	return value, err
+}
+
+// GetStringList has the same behaviour as GetString but splits the response on ListSeparator
+// (a comma by default). The raw value is split before the elements are unfolded, so that
+// a separator in the value of a reference does not split the element holding it.
+// Surrounding whitespace is trimmed from every element and empty elements are dropped,
+// so a blank value yields an empty list. Use GetStringListWith for other policies.
+func (c *ConfigFile) GetStringList(section string, option string) (list []string, err error) {
+	return c.GetStringListWith(section, option, ListOptions{})
+}
+
+// ListOptions controls how GetStringListWith splits a list. The zero value trims every
+// element and drops the empty ones, as GetStringList does.
+type ListOptions struct {
+	NoTrim    bool // Keep the whitespace surrounding the elements.
+	KeepEmpty bool // Keep empty elements, so that "a,,b," has four elements.
+
+	// Drop the elements equal to an earlier one, keeping the order of first appearance.
+	// Elements are compared without regard to case unless CaseSensitive is set.
+	Unique bool
+}
+
+// GetStringListWith has the same behaviour as GetStringList but applies opts.
+// A value that is empty, or blank unless NoTrim is set, still yields an empty list.
+func (c *ConfigFile) GetStringListWith(section string, option string, opts ListOptions) (list []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sv, err := c.getRawString(section, option)
+	if err != nil {
+		return nil, err
+	}
+	if section == "" {
+		section = "default"
+	}
+
+	list = []string{}
+	if sv == "" || !opts.NoTrim && strings.TrimSpace(sv) == "" {
+		return list, nil
+	}
+	seen := make(map[string]bool)
+	for _, s := range splitOutside(sv, c.listSeparator()) {
+		if s, err = c.expand(c.fold(section), c.fold(option), s); err != nil {
+			return nil, err
+		}
+		if !opts.NoTrim {
+			s = strings.TrimSpace(s)
+		}
+		if s == "" && !opts.KeepEmpty {
+			continue
+		}
+		if opts.Unique {
+			if seen[c.fold(s)] {
+				continue
+			}
+			seen[c.fold(s)] = true
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// GetLines has the same behaviour as GetString but splits the value into its lines, as
+// written with continuation lines. Trailing empty lines are dropped; other lines are kept
+// as they are, so an empty value yields an empty list. Use GetStringList to split a value
+// on ListSeparator instead.
+func (c *ConfigFile) GetLines(section string, option string) (lines []string, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	lines = strings.Split(sv, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines, nil
+}
+
+// GetBytes has the same behaviour as GetString but converts a size such as "256KB" to a
+// number of bytes. The value is an integer optionally followed by one of the units "B",
+// "KB", "MB", "GB" or "TB" (in any case). Units are binary: 1KB is 1024 bytes, 1MB is
+// 1024KB, and so on. A bare integer is a number of bytes.
+func (c *ConfigFile) GetBytes(section string, option string) (value int64, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	i := strings.IndexFunc(sv, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(sv)
+	}
+	multiplier, ok := byteUnits[strings.ToUpper(strings.TrimSpace(sv[i:]))]
+	if !ok {
+		return 0, GetError{CouldNotParse, "bytes", sv, section, option}
+	}
+	value, err = strconv.ParseInt(sv[:i], 10, 64)
+	if err != nil || value > math.MaxInt64/multiplier {
+		return 0, GetError{CouldNotParse, "bytes", sv, section, option}
+	}
+
+	return value * multiplier, nil
+}
+
+// GetIP has the same behaviour as GetString but parses the response as an IPv4 address,
+// such as "192.0.2.1", or an IPv6 address, such as "2001:db8::1".
+func (c *ConfigFile) GetIP(section string, option string) (value net.IP, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	if value = net.ParseIP(sv); value == nil {
+		return nil, GetError{CouldNotParse, "ip", sv, section, option}
+	}
+
+	return value, nil
+}
+
+// GetCIDR has the same behaviour as GetString but parses the response as an IP address
+// and prefix length in CIDR notation, such as "192.0.2.1/24" or "2001:db8::/32". It returns
+// the address and the network, as net.ParseCIDR does.
+func (c *ConfigFile) GetCIDR(section string, option string) (ip net.IP, network *net.IPNet, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ip, network, err = net.ParseCIDR(sv); err != nil {
+		return nil, nil, GetError{CouldNotParse, "cidr", sv, section, option}
+	}
+
+	return ip, network, nil
+}
+
+// GetURL has the same behaviour as GetString but parses the response with url.Parse,
+// once unfolded, so that a value such as "https://%(host)s/api" can be used. url.Parse
+// accepts relative references, so "example.com" is read as a path: use GetAbsoluteURL to
+// reject them.
+func (c *ConfigFile) GetURL(section string, option string) (value *url.URL, err error) {
+	sv, err := c.GetString(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, err = url.Parse(sv); err != nil {
+		return nil, GetError{CouldNotParse, "url", sv, section, option}
+	}
+
+	return value, nil
+}
+
+// GetAbsoluteURL has the same behaviour as GetURL but also rejects URLs without a scheme,
+// such as "example.com" or "/api", as a CouldNotParse error.
+func (c *ConfigFile) GetAbsoluteURL(section string, option string) (value *url.URL, err error) {
+	if value, err = c.GetURL(section, option); err != nil {
+		return nil, err
+	}
+
+	if !value.IsAbs() {
+		return nil, GetError{CouldNotParse, "url", value.String(), section, option}
+	}
+
+	return value, nil
+}
+
+// MustGetString has the same behaviour as GetString but panics with the error instead of
+// returning it. The MustGet functions are meant for options required at initialization,
+// in main or init, where a missing value is fatal anyway; do not use them while serving
+// requests.
+func (c *ConfigFile) MustGetString(section string, option string) string {
+	value, err := c.GetString(section, option)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// MustGetInt is GetInt, panicking on error (see MustGetString).
+func (c *ConfigFile) MustGetInt(section string, option string) int {
+	value, err := c.GetInt(section, option)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// MustGetBool is GetBool, panicking on error (see MustGetString).
+func (c *ConfigFile) MustGetBool(section string, option string) bool {
+	value, err := c.GetBool(section, option)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// MustGetFloat64 is GetFloat64, panicking on error (see MustGetString).
+func (c *ConfigFile) MustGetFloat64(section string, option string) float64 {
+	value, err := c.GetFloat64(section, option)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// splitQuoted splits s on sep outside of double quotes and of references, as described
+// for GetStringArray, reporting which elements were quoted; the empty unquoted elements
+// are kept. It returns false if s is malformed.
+func splitQuoted(s string, sep string) (list []string, quoted []bool, ok bool) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		var elem string
+		isQuoted := strings.HasPrefix(s, `"`)
+		if isQuoted {
+			buf := bytes.NewBuffer(nil)
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++ // escaped character
+				}
+				buf.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, nil, false // unterminated quote
+			}
+			elem = buf.String()
+			s = strings.TrimLeft(s[i+1:], " \t")
+			if s != "" && !strings.HasPrefix(s, sep) {
+				return nil, nil, false // text after the closing quote
+			}
+		} else {
+			i := len(splitOutside(s, sep)[0])
+			elem = strings.TrimSpace(s[:i])
+			s = s[i:]
+		}
+
+		list = append(list, elem)
+		quoted = append(quoted, isQuoted)
+		if s == "" {
+			return list, quoted, true
+		}
+		s = s[len(sep):]
+	}
+}
+
+// byteUnits maps the units accepted by GetBytes to their size in bytes.
+var byteUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// isMissing reports whether err is a GetError caused by a missing section or option.
+func isMissing(err error) bool {
+	e, ok := err.(GetError)
+	return ok && (e.Reason == SectionNotFound || e.Reason == OptionNotFound)
+}
+
+// expandEnv replaces ${NAME} references in value by the environment variable NAME.
+// References to unset variables are kept literally.
+func expandEnv(value string) string {
+	return envRegExp.ReplaceAllStringFunc(value, func(ref string) string {
+		if v, ok := os.LookupEnv(ref[2 : len(ref)-1]); ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// unfolding holds the settings of an unfolding beyond those of the configuration.
+type unfolding struct {
+	resolve func(name string) (string, bool) // Resolves references missing from the configuration.
+	depth   int                              // Maximum nesting of references; DepthValues if 0.
+	root    string                           // Section of the option being unfolded.
+}
+
+// expand returns the raw value of option in section after unfolding references and,
+// if ExpandEnv is set, environment variables; the result is trimmed if TrimValues is set.
+func (c *ConfigFile) expand(section string, option string, value string) (string, error) {
+	return c.expandWith(section, option, value, unfolding{})
+}
+
+// expandWith is expand with the settings of u.
+func (c *ConfigFile) expandWith(section string, option string, value string, u unfolding) (string, error) {
+	u.root = section
+	value, err := c.unfold(section, value, []string{option}, u)
+	if err != nil {
+		return "", err
+	}
+
+	if c.ExpandEnv {
+		value = expandEnv(value)
+	}
+	if c.TrimValues {
+		value = strings.TrimSpace(value)
+	}
+
+	return value, nil
+}
+
+// splitOutside splits value on sep, as strings.Split does, except within its %(name)s
+// references, so that a reference such as %(hosts:a,b)s is never cut.
+func splitOutside(value string, sep string) (list []string) {
+	refs := references(value)
+	start := 0
+	for i := 0; i+len(sep) <= len(value); {
+		if len(refs) > 0 && i >= refs[0][0] {
+			i = refs[0][1]
+			refs = refs[1:]
+			continue
+		}
+		if value[i:i+len(sep)] == sep {
+			list = append(list, value[start:i])
+			i += len(sep)
+			start = i
+			continue
+		}
+		i++
+	}
+
+	return append(list, value[start:])
+}
+
+// references returns the submatch indices of varRegExp for every %(name)s reference in
+// value, skipping the escaped percent signs as unfold does.
+func references(value string) (refs [][]int) {
+	for i := 0; i < len(value); {
+		j := strings.Index(value[i:], "%")
+		if j == -1 {
+			break
+		}
+		i += j
+		if strings.HasPrefix(value[i:], "%%") {
+			i += 2
+			continue
+		}
+		vr := varRegExp.FindStringSubmatchIndex(value[i:])
+		if vr == nil || vr[0] != 0 {
+			i++
+			continue
+		}
+		for k := range vr {
+			if vr[k] != -1 {
+				vr[k] += i
+			}
+		}
+		refs = append(refs, vr)
+		i = vr[1]
+	}
+
+	return refs
+}
+
+// unfold replaces the %(name)s references in value by the unfolded value of option name,
+// looked up in section and then in the default section. "%%" is replaced by a literal "%".
+// A %([other]name)s reference looks the option up in the section other instead, and the
+// references in its value are unfolded within other.
+// The path lists the options being unfolded, the one holding value last, written
+// [section]option if their section is not u.root; a reference back to one of them is
+// reported as a cycle. Nesting is limited to u.depth levels, or
+// DepthValues if u.depth is 0.
+// References to options that do not exist are passed to u.resolve, if set, and the
+// value it returns is used as is. Failing that, the default given in a reference of
+// the form %(name:default)s is used as is.
+func (c *ConfigFile) unfold(section string, value string, path []string, u unfolding) (string, error) {
+	depth := u.depth
+	if depth == 0 {
+		depth = DepthValues
+	}
+	if len(path) > depth {
+		return "", GetError{MaxDepthReached, "", "", u.root, path[0]}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for {
+		i := strings.Index(value, "%")
+		if i == -1 {
+			buf.WriteString(value)
+			break
+		}
+		buf.WriteString(value[:i])
+		value = value[i:]
+
+		if strings.HasPrefix(value, "%%") { // escaped percent sign
+			buf.WriteByte('%')
+			value = value[2:]
+			continue
+		}
+
+		vr := varRegExp.FindStringSubmatchIndex(value)
+		if vr == nil || vr[0] != 0 { // lone percent sign
+			buf.WriteByte('%')
+			value = value[1:]
+			continue
+		}
+
+		nsection := section
+		if vr[2] != -1 { // qualified by a section
+			nsection = c.fold(value[vr[2]:vr[3]])
+		}
+		noption := c.fold(value[vr[4]:vr[5]])
+		key := noption
+		if nsection != u.root {
+			key = "[" + nsection + "]" + noption
+		}
+		for _, o := range path {
+			if o == key {
+				chain := strings.Join(append(path, key), " -> ")
+				return "", GetError{MaxDepthReached, "", chain, u.root, path[0]}
+			}
+		}
+
+		s, err := c.extended(nsection, noption)
+		if err != nil {
+			return "", err
+		}
+		if s == "" {
+			s = DefaultSection
+		}
+		nvalue, ok := c.data[s][noption]
+		if ok { // defined in the configuration, so unfolded as well
+			var err error
+			if nvalue, err = c.unfold(nsection, nvalue, append(path[:len(path):len(path)], key), u); err != nil {
+				return "", err
+			}
+		} else if u.resolve != nil {
+			nvalue, ok = u.resolve(value[2:vr[5]])
+		}
+		if !ok && vr[6] != -1 {
+			nvalue, ok = value[vr[6]:vr[7]], true // default given in the reference
+		}
+		if !ok {
+			return "", GetError{OptionNotFound, "", "", nsection, noption}
+		}
+
+		buf.WriteString(nvalue)
+		value = value[vr[1]:]
+	}
+
+	return buf.String(), nil
+}
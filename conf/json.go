@@ -0,0 +1,152 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MarshalJSON returns the configuration as a JSON object that maps every section, the
+// default section included under its name, to an object of its options and their
+// unfolded values. Values are kept as strings. Sections and options appear in insertion
+// order. It implements json.Marshaler.
+func (c *ConfigFile) MarshalJSON() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+	for i, section := range c.sections {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, section)
+		buf.WriteString(":{")
+		for j, option := range c.options[section] {
+			value, err := c.expand(section, option, c.data[section][option])
+			if err != nil {
+				return nil, err
+			}
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, option)
+			buf.WriteByte(':')
+			writeJSONString(buf, value)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// ReadFromJSON reads a JSON object mapping sections to objects of options, as written by
+// MarshalJSON, into the configuration. String values are stored as they are; numbers,
+// booleans and null are stored as their JSON text ("" for null). Nested objects and arrays
+// are rejected with an error naming the offending key path. On error, the configuration
+// is left unchanged.
+func (c *ConfigFile) ReadFromJSON(reader io.Reader) (err error) {
+	n := c.empty() // decoded without holding the lock, which a slow reader would keep
+	if err = n.readFromJSON(reader); err != nil {
+		return err
+	}
+
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+	for _, section := range n.sections {
+		c.addSection(section)
+		for _, option := range n.options[section] {
+			c.addOption(section, option, n.data[section][option])
+			c.setSource(section, option, SourceReader)
+		}
+	}
+
+	return nil
+}
+
+// readFromJSON is ReadFromJSON without locking.
+func (c *ConfigFile) readFromJSON(reader io.Reader) (err error) {
+	dec := json.NewDecoder(reader)
+	dec.UseNumber()
+
+	if err = expectJSONDelim(dec, '{', "configuration"); err != nil {
+		return err
+	}
+	for dec.More() {
+		section, err := readJSONKey(dec)
+		if err != nil {
+			return err
+		}
+		if err = expectJSONDelim(dec, '{', section); err != nil {
+			return err
+		}
+		c.addSection(section)
+
+		for dec.More() {
+			option, err := readJSONKey(dec)
+			if err != nil {
+				return err
+			}
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			var value string
+			switch v := tok.(type) {
+			case string:
+				value = v
+			case json.Number:
+				value = v.String()
+			case bool:
+				value = strconv.FormatBool(v)
+			case nil:
+				value = ""
+			default:
+				return fmt.Errorf("json: value of %s.%s must not be an object or an array", section, option)
+			}
+			c.addOption(section, option, value)
+		}
+		if _, err = dec.Token(); err != nil { // end of section
+			return err
+		}
+	}
+	_, err = dec.Token() // end of configuration
+
+	return err
+}
+
+// expectJSONDelim reads the next token of dec and checks that it is delim.
+// The name describes the value being read, for the error message.
+func expectJSONDelim(dec *json.Decoder, delim json.Delim, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("json: %s must be an object", name)
+	}
+	return nil
+}
+
+// readJSONKey reads an object key from dec.
+func readJSONKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	return tok.(string), nil // the decoder only returns strings for object keys
+}
+
+// writeJSONString writes s to buf as a JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s) // strings always marshal
+	buf.Write(b)
+}
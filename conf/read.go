@@ -4,29 +4,186 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
 // ReadConfigFile reads a file and returns a new configuration representation.
 // This representation can be queried with GetString, etc.
 func ReadConfigFile(fname string) (c *ConfigFile, err error) {
-	var file *os.File
-
-	if file, err = os.Open(fname); err != nil {
+	c = NewConfigFile()
+	if err = c.readFile(fname); err != nil {
 		return nil, err
 	}
 
-	c = NewConfigFile()
-	if err = c.Read(file); err != nil {
-		return nil, err
+	return c, nil
+}
+
+// ReadFiles reads the files in turn into the configuration, so that the values of a file
+// override those of the files before it, as a sequence of Merge calls would. It stops at
+// the first file that cannot be opened or parsed; the error names that file, either as
+// an *os.PathError or as a ReadError with File set. The files read before are kept.
+func (c *ConfigFile) ReadFiles(filenames ...string) error {
+	for _, fname := range filenames {
+		if err := c.readFile(fname); err != nil {
+			return err
+		}
 	}
 
-	if err = file.Close(); err != nil {
+	return nil
+}
+
+// setFile sets File in err, or in the errors of err, if they are ReadErrors without File.
+func setFile(err error, fname string) error {
+	switch e := err.(type) {
+	case ReadError:
+		if e.File == "" {
+			e.File = fname
+		}
+		return e
+	case MultiError:
+		for i := range e {
+			e[i] = setFile(e[i], fname)
+		}
+	}
+	return err
+}
+
+// ReadGlob reads the files matching the filepath.Glob pattern, in sorted order, as
+// ReadFiles does. A pattern matching no file is not an error, so that an optional drop-in
+// directory such as "/etc/app.d/*.conf" may be empty.
+func (c *ConfigFile) ReadGlob(pattern string) error {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	sort.Strings(filenames)
+
+	return c.ReadFiles(filenames...)
+}
+
+// readFile reads the file fname into c, setting File in the ReadError it may return.
+func (c *ConfigFile) readFile(fname string) error {
+	data, err := ioutil.ReadFile(fname) // read without holding the lock
+	if err != nil {
+		return err
+	}
+
+	files := []string{filepath.Clean(fname)}
+	inc := make(includes)
+	c.readIncludes(data, files, inc)
+
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+	if _, err = c.readFrom(bytes.NewReader(data), files, inc); err != nil {
+		return setFile(err, fname)
+	}
+
+	return nil
+}
+
+// includePath returns the path given by l if l is an include directive.
+func (c *ConfigFile) includePath(l string) (path string, ok bool) {
+	if c.IncludeDirective == "" || !strings.HasPrefix(l, c.IncludeDirective) {
+		return "", false
+	}
+
+	rest := l[len(c.IncludeDirective):]
+	path = strings.TrimLeft(rest, " \t")
+	if path != "" && strings.IndexByte(string(c.delimiters()), path[0]) != -1 {
+		path = path[1:] // "@include = file"
+	} else if len(path) == len(rest) {
+		return "", false // the directive is only the beginning of a word
+	}
+	path = strings.TrimSpace(path)
+
+	return path, path != ""
+}
+
+// includes holds the files included by those being read, by clean path, as read by
+// readIncludes before the lock is taken.
+type includes map[string]includedFile
+
+type includedFile struct {
+	data []byte
+	err  error // error reading the file, returned if it is actually included
+}
+
+// includeChain returns files followed by the clean path of the file fname they include,
+// or an IncludeCycleError if that file is already being read.
+func includeChain(fname string, files []string) ([]string, error) {
+	if !filepath.IsAbs(fname) && len(files) > 0 {
+		fname = filepath.Join(filepath.Dir(files[len(files)-1]), fname)
+	}
+	fname = filepath.Clean(fname)
+	files = append(files[:len(files):len(files)], fname)
+	for _, f := range files[:len(files)-1] {
+		if f == fname {
+			return nil, IncludeCycleError{files}
+		}
+	}
+
+	return files, nil
+}
+
+// readIncludes reads into inc the files included by data, the contents of the last of
+// files, and in turn by them, so that the lock is not held while they are read. Cycles
+// are left to the parser, which reports them.
+func (c *ConfigFile) readIncludes(data []byte, files []string, inc includes) {
+	if c.IncludeDirective == "" {
+		return
+	}
+
+	for _, l := range strings.Split(string(data), "\n") {
+		fname, ok := c.includePath(strings.TrimSpace(l))
+		if !ok {
+			continue
+		}
+		chain, err := includeChain(fname, files)
+		if err != nil {
+			continue
+		}
+		fname = chain[len(chain)-1]
+		if _, ok := inc[fname]; ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(fname)
+		inc[fname] = includedFile{data, err}
+		if err == nil {
+			c.readIncludes(data, chain, inc)
+		}
+	}
+}
+
+// include reads the file fname, included by the last of files, into c, and returns the
+// comments left at its end, which belong to the lines following the directive. The
+// pending comments come before the first line of the file.
+func (c *ConfigFile) include(fname string, files []string, inc includes, comments []string) ([]string, error) {
+	files, err := includeChain(fname, files)
+	if err != nil {
 		return nil, err
 	}
+	fname = files[len(files)-1]
 
-	return c, nil
+	f, ok := inc[fname]
+	if !ok { // not seen by readIncludes, as in a directive continued over several lines
+		f.data, f.err = ioutil.ReadFile(fname)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	_, comments, err = c.readLines(bytes.NewReader(f.data), files, inc, comments)
+	return comments, setFile(err, fname)
 }
 
 func ReadConfigBytes(conf []byte) (c *ConfigFile, err error) {
@@ -40,76 +197,458 @@ func ReadConfigBytes(conf []byte) (c *ConfigFile, err error) {
 	return c, err
 }
 
+// ReadString returns the configuration parsed from s, as ReadConfigBytes does. Parse
+// errors are ReadErrors carrying the line number, as when reading a file.
+func ReadString(s string) (c *ConfigFile, err error) {
+	c = NewConfigFile()
+	if _, err = c.ReadFrom(strings.NewReader(s)); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload replaces the configuration with the contents of the file fname, and clears the
+// list of changed options (see Dirty).
+// The file is parsed first, with the current settings, and the configuration is only
+// replaced if parsing succeeds; on error it is left exactly as it was.
+func (c *ConfigFile) Reload(fname string) (err error) {
+	n := c.empty()
+	if err = n.readFile(fname); err != nil {
+		return err
+	}
+
+	return c.replace(n)
+}
+
+// replace replaces the contents of c with those of n, and clears the list of changed
+// options. The settings of c are kept. It returns ErrFrozen if c is frozen.
+func (c *ConfigFile) replace(n *ConfigFile) error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	c.data = n.data
+	c.sections = n.sections
+	c.options = n.options
+	c.sectionComments = n.sectionComments
+	c.optionComments = n.optionComments
+	c.header = n.header
+	c.footer = n.footer
+	c.arrays = n.arrays
+	c.dirty = nil
+	c.sources = n.sources
+
+	return nil
+}
+
 // Read reads an io.Reader and returns a configuration representation. This
 // representation can be queried with GetString, etc.
 func (c *ConfigFile) Read(reader io.Reader) (err error) {
+	_, err = c.ReadFrom(reader)
+	return err
+}
+
+// ReadFrom parses the configuration read from the io.Reader into c.
+// It returns the number of bytes read and implements io.ReaderFrom.
+// Parse errors, such as a line without delimiter, a section header without closing
+// bracket or, with QuoteValues set, a quoted value without closing quote, are reported as
+// a ReadError carrying the line number and the line. With StrictDuplicates
+// set, the whole input is read and every duplicate is reported, as a MultiError of
+// ReadErrors.
+//
+// A value can span several lines in two ways:
+//
+//	sql = SELECT id, name \
+//	      FROM users
+//
+// joins a line ending in a backslash with the next one, dropping the backslash and the
+// leading whitespace of the next line (giving "SELECT id, name FROM users"). A line
+// ending in a double backslash is not continued. Only a backslash at the very end of the
+// line counts, so a value such as C:\dir\file is read as is, and comment lines are never
+// continued. Alternatively,
+//
+//	key = first
+//	  second
+//
+// appends a line indented deeper than the option line to the value, separated by a
+// newline (giving "first\nsecond"). An indented line holding a delimiter, such as
+// "  second = x", still starts a new option, so that files indenting their options read
+// as before; escape the delimiter with a backslash, as in "  second \= x", to continue
+// the value with it. As before, a line without a delimiter that follows an option also
+// continues its value.
+//
+// A section header written [[name]] starts a new element of the section array name:
+// each occurrence creates a section named name.0, name.1, and so on (see GetSectionList).
+// A header written [name] behaves as usual, creating or continuing a single section.
+//
+// Comment and blank lines are kept with the section or option that follows them, and
+// written back by Write and WriteTo.
+//
+// If UnsetValue is set, say to "!unset", a line such as "port = !unset" removes the option
+// port from the section, if it was set by an earlier line or file, instead of setting it.
+// In the default section it removes the option from the default section, and so from
+// the sections inheriting it; in another section, it cannot remove an option inherited
+// from the default section.
+//
+// If IncludeDirective is set, say to "@include", a line such as
+//
+//	@include common.conf
+//
+// or "@include = common.conf" reads the file common.conf at that point, as a file of its
+// own: its options before any section header belong to the default section, and the
+// following lines continue the section in which the directive appeared. A relative path
+// is relative to the directory of the including file, or to the working directory when
+// reading from an io.Reader. A file including itself, directly or not, is reported as
+// an IncludeCycleError. The included files are read, as the input is, before c is
+// locked. The comments at the end of an included file are kept with the lines following
+// the directive.
+func (c *ConfigFile) ReadFrom(reader io.Reader) (n int64, err error) {
+	// The input is read first, so that a slow reader does not hold the lock. It is parsed
+	// into c itself, as the numbering of section arrays and UnsetValue depend on c.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	inc := make(includes)
+	c.readIncludes(data, nil, inc)
+
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return 0, ErrFrozen
+	}
+
+	return c.readFrom(bytes.NewReader(data), nil, inc)
+}
+
+// readFrom is ReadFrom without locking. The files are those being read, the one reader
+// belongs to last, if any, and inc holds the files they include.
+func (c *ConfigFile) readFrom(reader io.Reader, files []string, inc includes) (n int64, err error) {
+	n, comments, err := c.readLines(reader, files, inc, nil)
+	c.footer = append(c.footer, comments...)
+
+	return n, err
+}
+
+// readLines parses the lines of reader into c, as readFrom does, starting with the
+// pending comments, and returns the comments left at its end.
+func (c *ConfigFile) readLines(reader io.Reader, files []string, inc includes, comments []string) (n int64, rest []string, err error) {
 	buf := bufio.NewReader(reader)
+	source := SourceReader
+	if len(files) > 0 {
+		source = files[len(files)-1]
+	}
 
-	var section, option string
+	var section, option, joined string
+	// comments holds the comment and blank lines since the last section or option
+	seen := make(map[string]map[string]bool) // sections and options read, for StrictDuplicates
+	var duplicates MultiError                // duplicates found, with StrictDuplicates
+	var continued bool
+	var indent, optionIndent int
+	top := len(files) <= 1 && c.blank() // no line but comments read yet, in the first file
 	section = "default"
-	for {
-		l, buferr := buf.ReadString('\n') // parse line-by-line
-		l = strings.TrimSpace(l)
+	for lineno := 1; ; lineno++ {
+		raw, buferr := buf.ReadString('\n') // parse line-by-line
+		n += int64(len(raw))
+		l := strings.TrimSpace(raw)
 
 		if buferr != nil {
 			if buferr != io.EOF {
-				return err
+				return n, nil, buferr
 			}
 
-			if len(l) == 0 {
+			if len(l) == 0 && !continued {
+				rest = trimBlankLines(comments)
 				break
 			}
 		}
 
+		if continued { // previous line ended in a backslash
+			l = joined + l
+			continued = false
+		} else {
+			indent = len(raw) - len(strings.TrimLeft(raw, " \t"))
+		}
+		if strings.HasSuffix(l, "\\") && !strings.HasSuffix(l, "\\\\") && !c.isComment(l) && buferr == nil {
+			joined = l[:len(l)-1]
+			continued = true
+			continue
+		}
+
+		if top && len(l) > 0 && !c.isComment(l) {
+			top = false
+			for i, comment := range comments {
+				if len(comment) == 0 { // the comments before the first blank line are the header
+					c.header = comments[:i:i]
+					comments = comments[i+1:]
+					break
+				}
+			}
+		}
+
+		include, isInclude := c.includePath(l)
+
 		// switch written for readability (not performance)
 		switch {
 		case len(l) == 0: // empty line
+			comments = append(comments, l)
 			continue
 
-		case l[0] == '#': // comment
+		case c.isComment(l): // comment (see CommentChars)
+			comments = append(comments, l)
 			continue
 
-		case l[0] == ';': // comment
-			continue
-
-		case len(l) >= 3 && strings.ToLower(l[0:3]) == "rem": // comment (for windows users)
-			continue
+		case isInclude: // include directive (see IncludeDirective)
+			option = "" // reset multi-line value
+			if comments, err = c.include(include, files, inc, comments); err != nil {
+				return n, nil, err
+			}
 
 		case l[0] == '[' && l[len(l)-1] == ']': // new section
 			option = "" // reset multi-line value
-			section = strings.TrimSpace(l[1 : len(l)-1])
-			c.AddSection(section)
+
+			if len(l) >= 4 && l[1] == '[' && l[len(l)-2] == ']' { // new element of a section array
+				section = c.addArraySection(strings.TrimSpace(l[2 : len(l)-2]))
+			} else {
+				section = strings.TrimSpace(l[1 : len(l)-1])
+				if _, ok := seen[c.fold(section)]; ok && c.StrictDuplicates {
+					duplicates = append(duplicates, ReadError{DuplicateSection, l, lineno, section, "", ""})
+				}
+				c.addSection(section)
+			}
+			if seen[c.fold(section)] == nil {
+				seen[c.fold(section)] = make(map[string]bool)
+			}
+			if comments = trimBlankLines(comments); len(comments) > 0 {
+				s := c.fold(section)
+				c.sectionComments[s] = append(c.sectionComments[s], comments...)
+				comments = nil
+			}
 
 		case section == "": // not new section and no section defined so far
-			return ReadError{BlankSection, l}
+			return n, nil, ReadError{BlankSection, l, lineno, "", "", ""}
+
+		case option != "" && indent > optionIndent && c.delimiterIndex(l) <= 0: // indented continuation of multi-line value
+			prev, _ := c.getRawString(section, option)
+			value := strings.TrimSpace(c.stripComments(l))
+			for _, d := range c.delimiters() {
+				value = strings.Replace(value, "\\"+string(d), string(d), -1)
+			}
+			c.addOption(section, option, prev+"\n"+value)
+
+		case l[0] == '[': // section header without closing bracket
+			return n, nil, ReadError{MalformedSection, l, lineno, section, "", ""}
 
 		default: // other alternatives
-			i := strings.IndexAny(l, "=:")
+			i := strings.IndexAny(l, string(c.delimiters()))
 			switch {
 			case i > 0: // option and value
-				i := strings.IndexAny(l, "=:")
 				option = strings.TrimSpace(l[0:i])
-				value := strings.TrimSpace(stripComments(l[i+1:]))
-				c.AddOption(section, option, value)
+				optionIndent = indent
+				repeated := seen[c.fold(section)][c.fold(option)]
+				if repeated && c.StrictDuplicates {
+					duplicates = append(duplicates, ReadError{DuplicateOption, l, lineno, section, option, ""})
+				}
+				if seen[c.fold(section)] == nil {
+					seen[c.fold(section)] = make(map[string]bool)
+				}
+				seen[c.fold(section)][c.fold(option)] = true
+				raw := strings.TrimSpace(l[i+1:])
+				if c.QuoteValues && strings.HasPrefix(raw, "\"") && closingQuote(raw) == -1 {
+					return n, nil, ReadError{UnterminatedQuote, l, lineno, section, option, ""}
+				}
+				value, ok := c.unquoteValue(raw)
+				if !ok {
+					value = strings.TrimSpace(c.stripComments(l[i+1:]))
+				}
+				if c.UnsetValue != "" && value == c.UnsetValue {
+					c.unset(section, option)
+					option = "" // nothing to continue
+					break
+				}
+				if prev, ok := c.data[c.fold(section)][c.fold(option)]; ok && repeated && c.AllowRepeatedKeys {
+					value = prev + c.listSeparator() + value
+				}
+				c.addOption(section, option, value)
+				c.setSource(section, option, source)
+				if len(comments) > 0 {
+					c.setOptionComments(section, option, comments)
+					comments = nil
+				}
 
 			case section != "" && option != "": // continuation of multi-line value
-				prev, _ := c.GetRawString(section, option)
-				value := strings.TrimSpace(stripComments(l))
-				c.AddOption(section, option, prev+"\n"+value)
+				prev, _ := c.getRawString(section, option)
+				value := strings.TrimSpace(c.stripComments(l))
+				c.addOption(section, option, prev+"\n"+value)
 
 			default:
-				return ReadError{CouldNotParse, l}
+				return n, nil, ReadError{CouldNotParse, l, lineno, section, option, ""}
 			}
 		}
 
 		// Reached end of file
 		if buferr == io.EOF {
+			rest = trimBlankLines(comments)
 			break
 		}
 	}
+	if len(duplicates) > 0 {
+		return n, rest, duplicates
+	}
+	return n, rest, nil
+}
+
+// ImportEnviron sets an option in section for every environment variable whose name
+// starts with prefix; an empty prefix imports every variable. The option name is the
+// variable name without the prefix, lower-cased, with each underscore replaced by
+// EnvironSeparator if set: with prefix "APP_", APP_DB_HOST becomes db_host, or db.host
+// with EnvironSeparator set to ".". Variables whose name is just prefix are skipped.
+// Options already in section are overwritten; the section is created if needed.
+// It returns ErrFrozen if c is frozen.
+func (c *ConfigFile) ImportEnviron(section string, prefix string) error {
+	c.lock()
+	defer c.mu.Unlock()
+
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	c.addSection(section)
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		if i == -1 || !strings.HasPrefix(env[:i], prefix) || i == len(prefix) {
+			continue
+		}
+		option := strings.ToLower(env[len(prefix):i])
+		if c.EnvironSeparator != "" {
+			option = strings.Replace(option, "_", c.EnvironSeparator, -1)
+		}
+		c.addOption(section, option, env[i+1:])
+		c.markDirty(section, option)
+		c.setSource(section, option, SourceEnviron)
+	}
+
 	return nil
 }
 
+// addArraySection adds a new section to the section array name and returns its name.
+func (c *ConfigFile) addArraySection(name string) string {
+	name = c.fold(name)
+
+	for i := len(c.arrays[name]); ; i++ {
+		section := name + "." + strconv.Itoa(i)
+		if c.addSection(section) {
+			c.arrays[name] = append(c.arrays[name], section)
+			return section
+		}
+	}
+}
+
+// setOptionComments attaches comment lines to an existing option.
+func (c *ConfigFile) setOptionComments(section string, option string, lines []string) {
+	section = c.fold(section)
+	option = c.fold(option)
+
+	if c.optionComments[section] == nil {
+		c.optionComments[section] = make(map[string][]string)
+	}
+	c.optionComments[section][option] = lines
+}
+
+// unquoteValue unquotes a value written within double quotes by the writer, followed
+// by nothing but an optional comment. It returns false if QuoteValues is not set or
+// value is not such a quoted value.
+func (c *ConfigFile) unquoteValue(value string) (string, bool) {
+	if !c.QuoteValues || !strings.HasPrefix(value, "\"") {
+		return "", false
+	}
+
+	i := closingQuote(value)
+	if i == -1 {
+		return "", false
+	}
+	if rest := strings.TrimSpace(value[i+1:]); rest != "" && !c.isComment(rest) {
+		return "", false
+	}
+	unquoted, err := strconv.Unquote(value[:i+1])
+	return unquoted, err == nil
+}
+
+// closingQuote returns the index of the quote closing the one value starts with, skipping
+// the characters escaped with a backslash, or -1 if the quote is not closed.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// trimBlankLines drops the leading blank lines; the writer separates sections itself.
+func trimBlankLines(lines []string) []string {
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	return lines
+}
+
+// delimiterIndex returns the index of the first delimiter in l that is not escaped with a
+// backslash, or -1 if there is none.
+func (c *ConfigFile) delimiterIndex(l string) int {
+	delimiters := string(c.delimiters())
+	for i := 0; i < len(l); i++ {
+		switch {
+		case l[i] == '\\' && i+1 < len(l) && strings.IndexByte(delimiters, l[i+1]) >= 0:
+			i++ // skip the escaped delimiter
+		case strings.IndexByte(delimiters, l[i]) >= 0:
+			return i
+		}
+	}
+
+	return -1
+}
+
+// stripComments removes a trailing comment from the value l. With InlineComments set,
+// the value is cut at the first CommentChars marker that is neither quoted nor escaped
+// with a backslash (the backslash is dropped), a marker starting with a letter only
+// counting after whitespace; otherwise, at a "#" or ";" preceded by a space or a tab.
+func (c *ConfigFile) stripComments(l string) string {
+	if !c.InlineComments {
+		return stripComments(l)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	quoted := false
+	for i := 0; i < len(l); i++ {
+		if l[i] == '\\' {
+			if m := c.commentMarker(l[i+1:]); m != "" { // escaped marker
+				buf.WriteString(m)
+				i += len(m)
+				continue
+			}
+		}
+		if l[i] == '"' {
+			quoted = !quoted
+		} else if m := c.commentMarker(l[i:]); !quoted && m != "" {
+			if !unicode.IsLetter(rune(m[0])) || i == 0 || l[i-1] == ' ' || l[i-1] == '\t' {
+				return buf.String()
+			}
+		}
+		buf.WriteByte(l[i])
+	}
+	return buf.String()
+}
+
 func stripComments(l string) string {
 	// comments are preceded by space or TAB
 	for _, c := range []string{" ;", "\t;", " #", "\t#"} {
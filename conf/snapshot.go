@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"strings"
+)
+
+// SnapshotVersion is the version of the format written by Encode. Decode rejects
+// snapshots of any other version.
+const SnapshotVersion = 1
+
+// ErrSnapshotVersion is returned by Decode for data that is not a snapshot of the
+// current SnapshotVersion, such as a snapshot written by an older version of the
+// package. The configuration should then be read from its source again.
+var ErrSnapshotVersion = errors.New("conf: unsupported snapshot version")
+
+// snapshotMagic starts every snapshot.
+const snapshotMagic = "goconf snapshot"
+
+type snapshotHeader struct {
+	Magic   string
+	Version int
+}
+
+type snapshot struct {
+	Sections []string
+	Options  map[string][]string
+	Data     map[string]map[string]string
+	Arrays   map[string][]string
+}
+
+// Encode writes a binary snapshot of the configuration, using encoding/gob, that Decode
+// restores faster than the configuration can be parsed. The snapshot holds the unfolded
+// value of every option, with the percent signs escaped so that they unfold to the same
+// value again, and the order of the sections and options; comments and settings such as
+// ListSeparator are not part of it. It returns an error if a value cannot be unfolded.
+func (c *ConfigFile) Encode(writer io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := snapshot{
+		Sections: c.sections,
+		Options:  c.options,
+		Data:     make(map[string]map[string]string, len(c.data)),
+		Arrays:   c.arrays,
+	}
+	for section, options := range c.data {
+		s.Data[section] = make(map[string]string, len(options))
+		for option, value := range options {
+			value, err := c.expand(section, option, value)
+			if err != nil {
+				return err
+			}
+			s.Data[section][option] = strings.Replace(value, "%", "%%", -1)
+		}
+	}
+
+	enc := gob.NewEncoder(writer)
+	if err := enc.Encode(snapshotHeader{snapshotMagic, SnapshotVersion}); err != nil {
+		return err
+	}
+	return enc.Encode(s)
+}
+
+// Decode replaces the configuration with a snapshot written by Encode, and clears the
+// list of changed options (see Dirty). It returns ErrSnapshotVersion if the snapshot is
+// of another version, or not a snapshot at all; the configuration is then unchanged.
+func (c *ConfigFile) Decode(reader io.Reader) error {
+	dec := gob.NewDecoder(reader)
+
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil || h.Magic != snapshotMagic || h.Version != SnapshotVersion {
+		return ErrSnapshotVersion
+	}
+	var s snapshot
+	if err := dec.Decode(&s); err != nil {
+		return err
+	}
+
+	n := c.empty()
+	for _, section := range s.Sections {
+		n.addSection(section)
+		for _, option := range s.Options[section] {
+			n.addOption(section, option, s.Data[section][option])
+			n.setSource(section, option, SourceReader)
+		}
+	}
+	for name, sections := range s.Arrays {
+		n.arrays[name] = sections
+	}
+
+	return c.replace(n)
+}
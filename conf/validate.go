@@ -0,0 +1,86 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// OptionRule describes an expectation about an option, checked by Validate.
+type OptionRule struct {
+	Section  string
+	Option   string
+	Required bool   // The option must exist.
+	Type     string // Expected type: "int", "bool", "float", "duration", or "" for any string.
+}
+
+// Validate checks the configuration against rules. Missing options are only reported
+// for rules marked Required; present options must unfold and parse as the rule's Type.
+// All violations are collected and returned together as a MultiError.
+func (c *ConfigFile) Validate(rules []OptionRule) error {
+	var violations MultiError
+
+	for _, r := range rules {
+		var err error
+
+		switch r.Type {
+		case "":
+			_, err = c.GetString(r.Section, r.Option)
+		case "int":
+			_, err = c.GetInt(r.Section, r.Option)
+		case "bool":
+			_, err = c.GetBool(r.Section, r.Option)
+		case "float":
+			_, err = c.GetFloat64(r.Section, r.Option)
+		case "duration":
+			_, err = c.GetDuration(r.Section, r.Option)
+		default:
+			err = fmt.Errorf("[%s] %s: unknown rule type '%s'", r.Section, r.Option, r.Type)
+		}
+
+		if err != nil && (r.Required || !isMissing(err)) {
+			violations = append(violations, err)
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
+
+// AnyOption, listed among the options allowed in a section, lets CheckAgainstSchema
+// accept any option in that section.
+const AnyOption = "*"
+
+// CheckAgainstSchema returns every option of the configuration that allowed does not
+// list, in the order of GetSections and GetOptionsLocal. allowed maps sections to the
+// names of the options they may hold, such as {"db": {"host", "port"}}. All the options
+// of a section missing from allowed are reported, and a section allowing AnyOption may
+// hold any option. Names are matched without regard to case, unless CaseSensitive is set.
+func (c *ConfigFile) CheckAgainstSchema(allowed map[string][]string) (unknown []OptionRef) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	schema := make(map[string]map[string]bool, len(allowed))
+	for section, options := range allowed {
+		section = c.fold(section)
+		if schema[section] == nil {
+			schema[section] = make(map[string]bool, len(options))
+		}
+		for _, option := range options {
+			schema[section][c.fold(option)] = true
+		}
+	}
+
+	for _, section := range c.sections {
+		if schema[section][AnyOption] {
+			continue
+		}
+		for _, option := range c.options[section] {
+			if !schema[section][option] && option != ExtendsOption {
+				unknown = append(unknown, OptionRef{section, option})
+			}
+		}
+	}
+
+	return unknown
+}
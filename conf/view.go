@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"time"
+)
+
+// SectionView gives access to the options of one section, as returned by Section.
+// It holds no data of its own: every call reads the configuration, so changes and
+// reloads are reflected.
+type SectionView struct {
+	c    *ConfigFile
+	name string
+}
+
+// Section returns a view of the section name, whose getters take an option and read it
+// in that section: db.GetInt("port") is c.GetInt("db", "port"). The getters of the view
+// thus read the options of the sections extended (see ExtendsOption), but not those of the
+// default section, which HasOption and Options do list.
+func (c *ConfigFile) Section(name string) *SectionView {
+	return &SectionView{c, name}
+}
+
+// Name returns the name of the section.
+func (v *SectionView) Name() string {
+	return v.name
+}
+
+// HasOption checks if the section, or the default section, has the option.
+func (v *SectionView) HasOption(option string) bool {
+	return v.c.HasOption(v.name, option)
+}
+
+// Options returns the options of the section, see ConfigFile.GetOptions.
+func (v *SectionView) Options() ([]string, error) {
+	return v.c.GetOptions(v.name)
+}
+
+// GetRawString is ConfigFile.GetRawString for an option of the section.
+func (v *SectionView) GetRawString(option string) (string, error) {
+	return v.c.GetRawString(v.name, option)
+}
+
+// GetString is ConfigFile.GetString for an option of the section.
+func (v *SectionView) GetString(option string) (string, error) {
+	return v.c.GetString(v.name, option)
+}
+
+// GetStringDefault is ConfigFile.GetStringDefault for an option of the section.
+func (v *SectionView) GetStringDefault(option string, fallback string) (string, error) {
+	return v.c.GetStringDefault(v.name, option, fallback)
+}
+
+// GetStringList is ConfigFile.GetStringList for an option of the section.
+func (v *SectionView) GetStringList(option string) ([]string, error) {
+	return v.c.GetStringList(v.name, option)
+}
+
+// GetInt is ConfigFile.GetInt for an option of the section.
+func (v *SectionView) GetInt(option string) (int, error) {
+	return v.c.GetInt(v.name, option)
+}
+
+// GetInt64 is ConfigFile.GetInt64 for an option of the section.
+func (v *SectionView) GetInt64(option string) (int64, error) {
+	return v.c.GetInt64(v.name, option)
+}
+
+// GetFloat64 is ConfigFile.GetFloat64 for an option of the section.
+func (v *SectionView) GetFloat64(option string) (float64, error) {
+	return v.c.GetFloat64(v.name, option)
+}
+
+// GetBool is ConfigFile.GetBool for an option of the section.
+func (v *SectionView) GetBool(option string) (bool, error) {
+	return v.c.GetBool(v.name, option)
+}
+
+// GetDuration is ConfigFile.GetDuration for an option of the section.
+func (v *SectionView) GetDuration(option string) (time.Duration, error) {
+	return v.c.GetDuration(v.name, option)
+}
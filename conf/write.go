@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // WriteConfigFile saves the configuration representation to a file.
@@ -12,10 +15,11 @@ import (
 func (c *ConfigFile) WriteConfigFile(fname string, perm uint32, header string) (err error) {
 	var file *os.File
 
-	if file, err = os.Create(fname); err != nil {
+	if file, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(perm)); err != nil {
 		return err
 	}
 	if err = c.Write(file, header); err != nil {
+		file.Close()
 		return err
 	}
 
@@ -32,33 +36,235 @@ func (c *ConfigFile) WriteConfigBytes(header string) (config []byte) {
 }
 
 // Writes the configuration file to the io.Writer.
+// The header is saved as a comment block at the top, one comment line per line of header,
+// starting with the first CommentChars marker, and followed by a blank line. It replaces
+// the comment block opening the file read, separated from the rest by a blank line, so
+// that writing a configuration read from such a file does not repeat its header.
 func (c *ConfigFile) Write(writer io.Writer, header string) (err error) {
+	_, err = c.writeTo(writer, header)
+	return err
+}
+
+// WriteTo writes the configuration file to the io.Writer, without a header.
+// It returns the number of bytes written and implements io.WriterTo, which is why it
+// takes no header argument; use Write to write one.
+//
+// If QuoteValues is set, a value that would not be read back unchanged is written as a
+// Go string literal within double quotes, with quotes, backslashes and newlines escaped:
+// a value starting or ending with whitespace, containing a delimiter, a newline or
+// something read as a comment, starting with a double quote or ending in a backslash.
+// The reader, with QuoteValues set as well, unquotes such values. Other values are
+// written as they are.
+func (c *ConfigFile) WriteTo(writer io.Writer) (n int64, err error) {
+	return c.writeTo(writer, "")
+}
+
+// writeTo serializes the configuration. The options of the default section are
+// written first, without a section line, unless OmitDefault is set, followed by the
+// other sections.
+// Comment lines kept by the reader are written before their section or option; the
+// header replaces the comment lines opening the file read, if any.
+func (c *ConfigFile) writeTo(writer io.Writer, header string) (n int64, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	buf := bytes.NewBuffer(nil)
 
+	headerLines := c.header
 	if header != "" {
-		if _, err = buf.WriteString("# " + header + "\n"); err != nil {
-			return err
+		headerLines = c.commentLines(header)
+	}
+	if len(headerLines) > 0 {
+		if err = writeLines(buf, headerLines); err != nil {
+			return 0, err
+		}
+		if _, err = buf.WriteString("\n"); err != nil {
+			return 0, err
 		}
 	}
 
-	for section, sectionmap := range c.data {
-		if section == DefaultSection && len(sectionmap) == 0 {
-			continue // skip default section if empty
+	if !c.OmitDefault {
+		if err = writeLines(buf, c.sectionComments[DefaultSection]); err != nil {
+			return 0, err
 		}
-		if _, err = buf.WriteString("[" + section + "]\n"); err != nil {
-			return err
+		if err = c.writeOptions(buf, DefaultSection); err != nil {
+			return 0, err
 		}
-		for option, value := range sectionmap {
-			if _, err = buf.WriteString(option + "=" + value + "\n"); err != nil {
-				return err
+		if len(c.data[DefaultSection]) > 0 {
+			if _, err = buf.WriteString("\n"); err != nil {
+				return 0, err
 			}
 		}
+	}
+
+	arrayOf := make(map[string]string) // maps array sections to their array name
+	for name, sections := range c.arrays {
+		for _, s := range sections {
+			arrayOf[s] = name
+		}
+	}
+
+	sections := c.sections
+	if c.SortOnWrite {
+		sections = sortedSections(sections, arrayOf)
+	}
+	for _, section := range sections {
+		if section == DefaultSection {
+			continue // already written
+		}
+		if err = writeLines(buf, c.sectionComments[section]); err != nil {
+			return 0, err
+		}
+		line := "[" + section + "]\n"
+		if name, ok := arrayOf[section]; ok {
+			line = "[[" + name + "]]\n"
+		}
+		if _, err = buf.WriteString(line); err != nil {
+			return 0, err
+		}
+		if err = c.writeOptions(buf, section); err != nil {
+			return 0, err
+		}
 		if _, err = buf.WriteString("\n"); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = writeLines(buf, c.footer); err != nil {
+		return 0, err
+	}
+
+	return buf.WriteTo(writer)
+}
+
+// WriteShellExport writes the options of section, including those of the default section,
+// as shell variable assignments that a POSIX shell can source:
+//
+//	DB_HOST="localhost"
+//
+// Values are unfolded and written within double quotes, with the characters special
+// there ("\"", "\\", "$" and "`") escaped by a backslash. Names are upper-cased, and every
+// character other than a letter, a digit or an underscore is replaced by an underscore,
+// as is a leading digit prefixed with one. It returns an error if the section does not
+// exist or a value cannot be unfolded.
+func (c *ConfigFile) WriteShellExport(writer io.Writer, section string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = "default"
+	}
+	section = c.fold(section)
+
+	if _, ok := c.data[section]; !ok {
+		return GetError{SectionNotFound, "", "", section, ""}
+	}
+
+	path, err := c.visible(section)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, option := range c.options[path[i]] {
+			if s, _ := c.extended(section, option); option == ExtendsOption || s != path[i] && s != "" {
+				continue // overridden by a nearer section
+			}
+			value, err := c.expand(section, option, c.data[path[i]][option])
+			if err != nil {
+				return err
+			}
+			buf.WriteString(shellName(option) + "=\"" + shellEscaper.Replace(value) + "\"\n")
+		}
+	}
+
+	_, err = buf.WriteTo(writer)
+	return err
+}
+
+// shellEscaper escapes the characters special within double quotes in a POSIX shell.
+var shellEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+// shellName turns an option name into a shell variable name.
+func shellName(option string) string {
+	name := []byte(strings.ToUpper(option))
+	for i, b := range name {
+		if !(b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// writeOptions writes the options of section to buf.
+func (c *ConfigFile) writeOptions(buf *bytes.Buffer, section string) (err error) {
+	options := c.options[section]
+	if c.SortOnWrite {
+		options = append([]string(nil), options...)
+		sort.Strings(options)
+	}
+	for _, option := range options {
+		if err = writeLines(buf, c.optionComments[section][option]); err != nil {
+			return err
+		}
+		if _, err = buf.WriteString(option + "=" + c.quoteValue(c.data[section][option]) + "\n"); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// sortedSections returns a sorted copy of sections. The sections of a section array are
+// sorted by array name and keep their order, so that they are read back as they were.
+func sortedSections(sections []string, arrayOf map[string]string) []string {
+	key := func(section string) string {
+		if name, ok := arrayOf[section]; ok {
+			return name
+		}
+		return section
+	}
+
+	sorted := append([]string(nil), sections...)
+	sort.Stable(bySectionKey{sorted, key})
+
+	return sorted
+}
 
-	buf.WriteTo(writer)
+// bySectionKey sorts sections by the key of their name.
+type bySectionKey struct {
+	sections []string
+	key      func(section string) string
+}
+
+func (s bySectionKey) Len() int           { return len(s.sections) }
+func (s bySectionKey) Swap(i, j int)      { s.sections[i], s.sections[j] = s.sections[j], s.sections[i] }
+func (s bySectionKey) Less(i, j int) bool { return s.key(s.sections[i]) < s.key(s.sections[j]) }
 
+// quoteValue returns value as written, quoted if needed (see QuoteValues).
+func (c *ConfigFile) quoteValue(value string) string {
+	if !c.QuoteValues || value == "" {
+		return value
+	}
+	if value != strings.TrimSpace(value) ||
+		strings.ContainsAny(value, string(c.delimiters())+"\n\"") ||
+		strings.HasSuffix(value, "\\") ||
+		c.isComment(value) ||
+		c.stripComments(value) != value {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// writeLines writes every line to buf.
+func writeLines(buf *bytes.Buffer, lines []string) (err error) {
+	for _, l := range lines {
+		if _, err = buf.WriteString(l + "\n"); err != nil {
+			return err
+		}
+	}
 	return nil
 }